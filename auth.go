@@ -0,0 +1,376 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SecretHeader is the http header carrying the shared secret checked by the
+	// SharedSecret authenticator.
+	// SignatureHeader is the http header carrying the key id and signature checked
+	// by the HMACSignature authenticator, formatted as keyId:signature.
+	// TimestampHeader is the http header carrying the issue time of the signature in
+	// unix seconds.
+	// NonceHeader is the http header carrying the nonce of the signature.
+	SecretHeader    = "X-Jrpc2-Secret"
+	SignatureHeader = "X-Jrpc2-Signature"
+	TimestampHeader = "X-Jrpc2-Timestamp"
+	NonceHeader     = "X-Jrpc2-Nonce"
+)
+
+// httpRequestKey is the context key of the http request a request was received
+// with.
+type httpRequestKey struct{}
+
+// HTTPRequestFromContext returns the http request the request was received with,
+// or the websocket handshake request of the connection it was received on. The
+// ok result is false for requests served by ServeConn.
+func HTTPRequestFromContext(ctx context.Context) (*http.Request, bool) {
+	r, ok := ctx.Value(httpRequestKey{}).(*http.Request)
+	return r, ok
+}
+
+// Authenticator authenticates the callers of the registry methods jrpc2.register,
+// jrpc2.unregister and jrpc2.heartbeat.
+type Authenticator interface {
+	// Authenticate returns the principal making the call of the method with the
+	// params, or an error if the caller can't be authenticated. The credentials of
+	// the caller are usually read from the http request returned by
+	// HTTPRequestFromContext.
+	Authenticate(ctx context.Context, method string, params json.RawMessage) (string, error)
+}
+
+// AuthenticatorFunc is a function that is used as an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, method string, params json.RawMessage) (string, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, method string, params json.RawMessage) (string, error) {
+	return f(ctx, method, params)
+}
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errExpiredSignature   = errors.New("signature expired")
+	errReusedSignature    = errors.New("signature already used")
+)
+
+// SharedSecret returns an authenticator that accepts callers sending the secret
+// in the SecretHeader header. The principal of the callers is "shared-secret".
+func SharedSecret(secret string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, method string, params json.RawMessage) (string, error) {
+		r, ok := HTTPRequestFromContext(ctx)
+		if !ok || r.Header.Get(SecretHeader) == "" {
+			return "", errMissingCredentials
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(secret)) != 1 {
+			return "", errInvalidCredentials
+		}
+
+		return "shared-secret", nil
+	})
+}
+
+// HMACSignature returns an authenticator that accepts callers signing the call
+// with one of the keys, by key id. A caller sends the key id and the signature
+// returned by SignParams, separated by a colon, in the SignatureHeader header, and
+// the issue time in unix seconds and a unique nonce it signed in the
+// TimestampHeader and NonceHeader headers. Signatures issued outside of the window
+// around the current time, 5 minutes if zero, and nonces already used within the
+// window are rejected. The principal of a caller is the key id.
+func HMACSignature(keys map[string][]byte, window time.Duration) Authenticator {
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+
+	return &hmacSignature{keys: keys, window: window, nonces: make(map[string]time.Time)}
+}
+
+type hmacSignature struct {
+	keys   map[string][]byte
+	window time.Duration
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func (a *hmacSignature) Authenticate(ctx context.Context, method string, params json.RawMessage) (string, error) {
+	r, ok := HTTPRequestFromContext(ctx)
+	if !ok || r.Header.Get(SignatureHeader) == "" || r.Header.Get(TimestampHeader) == "" || r.Header.Get(NonceHeader) == "" {
+		return "", errMissingCredentials
+	}
+	keyId, signature, ok := strings.Cut(r.Header.Get(SignatureHeader), ":")
+	key, known := a.keys[keyId]
+	if !ok || !known {
+		return "", errInvalidCredentials
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return "", errInvalidCredentials
+	}
+	issued := time.Unix(timestamp, 0)
+	if age := time.Since(issued); age > a.window || age < -a.window {
+		return "", errExpiredSignature
+	}
+	nonce := r.Header.Get(NonceHeader)
+	if !hmac.Equal([]byte(signature), []byte(SignParams(key, method, timestamp, nonce, params))) {
+		return "", errInvalidCredentials
+	}
+	if !a.useNonce(keyId+":"+nonce, issued.Add(a.window)) {
+		return "", errReusedSignature
+	}
+
+	return keyId, nil
+}
+
+// useNonce records the nonce until it expires, and reports whether it was unused.
+func (a *hmacSignature) useNonce(nonce string, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for n, exp := range a.nonces {
+		if now.After(exp) {
+			delete(a.nonces, n)
+		}
+	}
+	if _, used := a.nonces[nonce]; used {
+		return false
+	}
+	a.nonces[nonce] = expires
+
+	return true
+}
+
+// SignParams returns the hex encoded HMAC-SHA256 signature with the key of the
+// call of the method, issued at the timestamp in unix seconds with the nonce. The
+// method, timestamp, nonce and the compact json encoding of the params are signed,
+// separated by newlines.
+func SignParams(key []byte, method string, timestamp int64, nonce string, params json.RawMessage) string {
+	var compact bytes.Buffer
+	if json.Compact(&compact, params) != nil {
+		compact.Reset()
+		compact.Write(params)
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d\n%s\n", method, timestamp, nonce)
+	mac.Write(compact.Bytes())
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeaders returns the headers that authenticate a call of the method with
+// the params to the HMACSignature authenticator, signed now with the key and a
+// random nonce.
+func SignatureHeaders(keyId string, key []byte, method string, params json.RawMessage) map[string]string {
+	var b [16]byte
+	rand.Read(b[:])
+	nonce := hex.EncodeToString(b[:])
+	timestamp := time.Now().Unix()
+
+	return map[string]string{
+		SignatureHeader: keyId + ":" + SignParams(key, method, timestamp, nonce, params),
+		TimestampHeader: strconv.FormatInt(timestamp, 10),
+		NonceHeader:     nonce,
+	}
+}
+
+// BearerToken returns an authenticator that accepts callers sending a bearer
+// token in the Authorization header that verify accepts. verify returns the
+// principal of the token.
+func BearerToken(verify func(ctx context.Context, token string) (string, error)) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, method string, params json.RawMessage) (string, error) {
+		r, ok := HTTPRequestFromContext(ctx)
+		if !ok {
+			return "", errMissingCredentials
+		}
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errMissingCredentials
+		}
+
+		return verify(ctx, token)
+	})
+}
+
+// RegistrationPolicy controls who may change the proxied methods of a server with
+// the registry methods, and which methods they may register.
+type RegistrationPolicy struct {
+	// Authenticator authenticates the callers of the registry methods. Callers are
+	// not authenticated if it is nil.
+	// AllowedHosts contains the hosts that methods may be proxied to. An entry
+	// matches the host of a url with or without its port, and an entry starting
+	// with "*." matches the subdomains of the domain. Any host is allowed if empty.
+	// AllowedPrefixes contains the prefixes of the names that methods may be
+	// registered and unregistered under. Any name is allowed if empty.
+	// Audit is called with the audit record of every registration and
+	// unregistration. Records are logged if it is nil.
+	Authenticator   Authenticator
+	AllowedHosts    []string
+	AllowedPrefixes []string
+	Audit           func(record AuditRecord)
+}
+
+// AuditRecord records a call to a registry method that changes the proxied methods.
+type AuditRecord struct {
+	// Time is the time of the call.
+	// Action is "register", "unregister" or "heartbeat".
+	// Principal is the authenticated caller, empty if callers aren't authenticated
+	// or the caller failed to authenticate.
+	// RemoteAddr is the network address of the caller, if known.
+	// Name is the name of the method, empty for heartbeats.
+	// Url is the url of the backend, empty if all backends are unregistered.
+	// Error is the error object returned to the caller, nil if the call succeeded.
+	Time       time.Time    `json:"time"`
+	Action     string       `json:"action"`
+	Principal  string       `json:"principal,omitempty"`
+	RemoteAddr string       `json:"remoteAddr,omitempty"`
+	Name       string       `json:"name"`
+	Url        string       `json:"url,omitempty"`
+	Error      *ErrorObject `json:"error,omitempty"`
+}
+
+// authenticate authenticates the caller of the registry method and returns its
+// principal.
+func (s *Server) authenticate(ctx context.Context, method string, params json.RawMessage) (string, *ErrorObject) {
+	if s.Registration == nil || s.Registration.Authenticator == nil {
+		return "", nil
+	}
+
+	principal, err := s.Registration.Authenticator.Authenticate(ctx, method, params)
+	if err != nil {
+		return "", &ErrorObject{
+			Code:    UnauthorizedCode,
+			Message: UnauthorizedMsg,
+			Data:    err.Error(),
+		}
+	}
+
+	return principal, nil
+}
+
+// authorize authenticates the caller of the registry method and checks the name of
+// the registered method and the backend url, each if not empty, against the
+// allowlists.
+func (s *Server) authorize(ctx context.Context, method string, params json.RawMessage, name, rawUrl string) (string, *ErrorObject) {
+	principal, errObj := s.authenticate(ctx, method, params)
+	if errObj != nil || s.Registration == nil {
+		return principal, errObj
+	}
+
+	if name != "" && !allowedPrefix(s.Registration.AllowedPrefixes, name) {
+		return principal, &ErrorObject{
+			Code:    ForbiddenCode,
+			Message: ForbiddenMsg,
+			Data:    "method name is not allowed",
+		}
+	}
+	if rawUrl != "" && !allowedHost(s.Registration.AllowedHosts, rawUrl) {
+		return principal, &ErrorObject{
+			Code:    ForbiddenCode,
+			Message: ForbiddenMsg,
+			Data:    "url host is not allowed",
+		}
+	}
+
+	return principal, nil
+}
+
+// audit records the call of a registry method that changes the proxied methods or
+// renews their registrations.
+func (s *Server) audit(ctx context.Context, record AuditRecord) {
+	if s.Registration == nil {
+		return
+	}
+
+	record.Time = time.Now()
+	if r, ok := HTTPRequestFromContext(ctx); ok {
+		record.RemoteAddr = r.RemoteAddr
+	}
+	if s.Registration.Audit != nil {
+		s.Registration.Audit(record)
+		return
+	}
+
+	outcome := "ok"
+	if record.Error != nil {
+		outcome = record.Error.Error()
+	}
+	log.Printf("jrpc2: audit %s %s %s by %q from %s: %s", record.Action, record.Name, record.Url, record.Principal, record.RemoteAddr, outcome)
+}
+
+// allowedPrefix reports whether the name starts with one of the prefixes, or the
+// prefixes are empty.
+func allowedPrefix(prefixes []string, name string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedHost reports whether the host of the url matches one of the hosts, or the
+// hosts are empty.
+func allowedHost(hosts []string, rawUrl string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	hostname := strings.ToLower(u.Hostname())
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		switch {
+		case strings.HasPrefix(host, "*."):
+			if strings.HasSuffix(hostname, host[1:]) {
+				return true
+			}
+		case host == hostname || host == strings.ToLower(u.Host):
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,205 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withPolicy sets the registration policy of the test server, and returns a
+// function returning the audit records.
+func withPolicy(policy *RegistrationPolicy) (func(ts *testServer), func() []AuditRecord) {
+	var mu sync.Mutex
+	var records []AuditRecord
+	policy.Audit = func(record AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, record)
+	}
+
+	return func(ts *testServer) { ts.Registration = policy }, func() []AuditRecord {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]AuditRecord(nil), records...)
+	}
+}
+
+// errorCode returns the code of the error object, or zero if err is nil.
+func errorCode(t *testing.T, err error) ErrorCode {
+	if err == nil {
+		return 0
+	}
+	errObj, ok := err.(*ErrorObject)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	return errObj.Code
+}
+
+func TestRegisterSharedSecret(t *testing.T) {
+	policy, records := withPolicy(&RegistrationPolicy{Authenticator: SharedSecret("s3cret")})
+	url := newTestServer(t, policy).url
+	params := []string{"echo", "http://localhost:8080/rpc"}
+
+	table := []struct {
+		headers map[string]string
+		code    ErrorCode
+	}{
+		{nil, UnauthorizedCode},
+		{map[string]string{SecretHeader: "guess"}, UnauthorizedCode},
+		{map[string]string{SecretHeader: "s3cret"}, 0},
+	}
+	for _, tt := range table {
+		err := NewClient(url, tt.headers).Call(context.Background(), "jrpc2.register", params, nil)
+		if code := errorCode(t, err); code != tt.code {
+			t.Fatalf("Expected code %d with headers %v, got %v", tt.code, tt.headers, err)
+		}
+	}
+
+	audit := records()
+	if len(audit) != 3 {
+		t.Fatalf("Expected 3 audit records, got %v", audit)
+	}
+	last := audit[2]
+	if last.Action != "register" || last.Principal != "shared-secret" || last.Name != "echo" || last.Url != params[1] || last.Error != nil || last.RemoteAddr == "" {
+		t.Fatalf("Unexpected audit record %+v", last)
+	}
+	if audit[0].Error == nil || audit[0].Error.Code != UnauthorizedCode || audit[0].Principal != "" {
+		t.Fatalf("Expected failed registration to be audited, got %+v", audit[0])
+	}
+
+	err := NewClient(url, nil).Call(context.Background(), "jrpc2.unregister", []string{"echo"}, nil)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected unauthorized unregister, got %v", err)
+	}
+	err = NewClient(url, nil).Call(context.Background(), "jrpc2.heartbeat", []string{params[1]}, nil)
+	if code := errorCode(t, err); code != UnauthorizedCode {
+		t.Fatalf("Expected unauthorized heartbeat, got %v", err)
+	}
+	if audit := records(); len(audit) != 5 || audit[4].Action != "heartbeat" || audit[4].Url != params[1] || audit[4].Error == nil {
+		t.Fatalf("Expected heartbeat to be audited, got %v", audit)
+	}
+	err = NewClient(url, map[string]string{SecretHeader: "s3cret"}).Call(context.Background(), "jrpc2.unregister", []string{"echo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit := records(); len(audit) != 6 || audit[5].Action != "unregister" || audit[5].Error != nil {
+		t.Fatalf("Expected unregister to be audited, got %v", audit)
+	}
+}
+
+func TestRegisterHMACSignature(t *testing.T) {
+	key := []byte("key")
+	policy, records := withPolicy(&RegistrationPolicy{
+		Authenticator: HMACSignature(map[string][]byte{"backend-1": key}, time.Minute),
+	})
+	url := newTestServer(t, policy).url
+	params, _ := json.Marshal([]string{"echo", "http://localhost:8080/rpc"})
+	headers := SignatureHeaders("backend-1", key, "jrpc2.register", params)
+	unregister, _ := json.Marshal([]string{"echo"})
+	stale := time.Now().Add(-2 * time.Minute).Unix()
+
+	table := []struct {
+		headers map[string]string
+		method  string
+		params  json.RawMessage
+		code    ErrorCode
+	}{
+		{map[string]string{SignatureHeader: headers[SignatureHeader]}, "jrpc2.register", params, UnauthorizedCode},
+		{SignatureHeaders("backend-2", key, "jrpc2.register", params), "jrpc2.register", params, UnauthorizedCode},
+		{headers, "jrpc2.register", json.RawMessage(`["other", "http://localhost:8080/rpc"]`), UnauthorizedCode},
+		{headers, "jrpc2.unregister", params, UnauthorizedCode},
+		{map[string]string{
+			SignatureHeader: "backend-1:" + SignParams(key, "jrpc2.register", stale, "n", params),
+			TimestampHeader: strconv.FormatInt(stale, 10),
+			NonceHeader:     "n",
+		}, "jrpc2.register", params, UnauthorizedCode},
+		{headers, "jrpc2.register", params, 0},
+		{headers, "jrpc2.register", params, UnauthorizedCode},
+		{SignatureHeaders("backend-1", key, "jrpc2.unregister", unregister), "jrpc2.unregister", unregister, 0},
+	}
+	for i, tt := range table {
+		err := NewClient(url, tt.headers).Call(context.Background(), tt.method, tt.params, nil)
+		if code := errorCode(t, err); code != tt.code {
+			t.Fatalf("Expected code %d for call %d, got %v", tt.code, i, err)
+		}
+	}
+	if audit := records(); audit[5].Principal != "backend-1" || audit[6].Error == nil {
+		t.Fatalf("Expected key id principal and rejected replay, got %+v", audit)
+	}
+}
+
+func TestRegisterBearerToken(t *testing.T) {
+	policy, _ := withPolicy(&RegistrationPolicy{
+		Authenticator: BearerToken(func(ctx context.Context, token string) (string, error) {
+			if token != "valid" {
+				return "", errors.New("invalid token")
+			}
+			return "svc", nil
+		}),
+	})
+	url := newTestServer(t, policy).url
+	params := []string{"echo", "http://localhost:8080/rpc"}
+
+	table := []struct {
+		header string
+		code   ErrorCode
+	}{
+		{"", UnauthorizedCode},
+		{"Basic valid", UnauthorizedCode},
+		{"Bearer invalid", UnauthorizedCode},
+		{"Bearer valid", 0},
+	}
+	for _, tt := range table {
+		err := NewClient(url, map[string]string{"Authorization": tt.header}).Call(context.Background(), "jrpc2.register", params, nil)
+		if code := errorCode(t, err); code != tt.code {
+			t.Fatalf("Expected code %d with authorization %q, got %v", tt.code, tt.header, err)
+		}
+	}
+}
+
+func TestRegisterAllowlists(t *testing.T) {
+	policy, _ := withPolicy(&RegistrationPolicy{
+		AllowedHosts:    []string{"backend", "localhost:8080", "*.internal"},
+		AllowedPrefixes: []string{"svc."},
+	})
+	c := newTestServer(t, policy).client
+
+	table := []struct {
+		params []string
+		code   ErrorCode
+	}{
+		{[]string{"svc.a", "http://backend/rpc"}, 0},
+		{[]string{"svc.b", "http://backend:9000/rpc"}, 0},
+		{[]string{"svc.c", "http://localhost:8080/rpc"}, 0},
+		{[]string{"svc.d", "https://api.internal/rpc"}, 0},
+		{[]string{"svc.e", "http://localhost:9090/rpc"}, ForbiddenCode},
+		{[]string{"svc.f", "http://evil.com/rpc"}, ForbiddenCode},
+		{[]string{"svc.g", "http://internal/rpc"}, ForbiddenCode},
+		{[]string{"echo", "http://backend/rpc"}, ForbiddenCode},
+	}
+	err := c.Call(context.Background(), "jrpc2.register", []string{"echo", "http://backend/rpc"}, nil)
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Expected forbidden error, got %v", err)
+	}
+	for _, tt := range table {
+		err := c.Call(context.Background(), "jrpc2.register", tt.params, nil)
+		if code := errorCode(t, err); code != tt.code {
+			t.Fatalf("Expected code %d for %v, got %v", tt.code, tt.params, err)
+		}
+	}
+
+	err = c.Call(context.Background(), "jrpc2.heartbeat", []string{"http://evil.com/rpc"}, nil)
+	if code := errorCode(t, err); code != ForbiddenCode {
+		t.Fatalf("Expected forbidden heartbeat, got %v", err)
+	}
+	err = c.Call(context.Background(), "jrpc2.heartbeat", []string{"http://backend/rpc"}, nil)
+	if code := errorCode(t, err); code != InvalidParamsCode {
+		t.Fatalf("Expected heartbeat of an allowed host without ttl registrations, got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend is a backend server that handles calls to a proxied method.
+type Backend struct {
+	// Url is the url of the backend.
+	// Weight is the relative share of calls the backend receives from the weighted
+	// balancer, 1 if zero.
+	Url    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// BalanceRequest describes the proxied call whose backends are being ordered.
+type BalanceRequest struct {
+	// Method is the name of the called method.
+	// Params are the params of the call.
+	// Backends contains the healthy backends of the method, in registration order.
+	// InFlight returns the number of calls in flight to the backend at url.
+	Method   string
+	Params   json.RawMessage
+	Backends []Backend
+	InFlight func(url string) int
+}
+
+// Balancer balances the calls to a proxied method between its backends.
+type Balancer interface {
+	// Balance returns the backends of the call in the order they are tried. The
+	// call fails over to the next backend when a backend can't be reached.
+	Balance(req BalanceRequest) []Backend
+}
+
+// methodForgetter is implemented by balancers that keep state for each method,
+// which is dropped when the method is unregistered.
+type methodForgetter interface {
+	forget(method string)
+}
+
+// RoundRobin returns a balancer that sends the calls to each method to its
+// backends in turn.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	counters sync.Map
+}
+
+func (b *roundRobin) Balance(req BalanceRequest) []Backend {
+	c, _ := b.counters.LoadOrStore(req.Method, new(uint64))
+	n := atomic.AddUint64(c.(*uint64), 1) - 1
+
+	return rotate(req.Backends, int(n%uint64(len(req.Backends))))
+}
+
+func (b *roundRobin) forget(method string) {
+	b.counters.Delete(method)
+}
+
+// LeastInFlight returns a balancer that sends each call to the backend with the
+// fewest calls in flight. Backends with as many calls in flight are used in turn.
+func LeastInFlight() Balancer {
+	return &leastInFlight{}
+}
+
+type leastInFlight struct {
+	roundRobin
+}
+
+func (b *leastInFlight) Balance(req BalanceRequest) []Backend {
+	backends := b.roundRobin.Balance(req)
+	inFlight := make(map[string]int, len(backends))
+	for _, backend := range backends {
+		inFlight[backend.Url] = req.InFlight(backend.Url)
+	}
+	sort.SliceStable(backends, func(i, j int) bool {
+		return inFlight[backends[i].Url] < inFlight[backends[j].Url]
+	})
+
+	return backends
+}
+
+// Weighted returns a balancer that distributes the calls to each method between
+// its backends in proportion to their weights, using smooth weighted round-robin.
+// The state of a backend is dropped once it is no longer one of the backends of
+// the call, and the state of a method once it is unregistered.
+func Weighted() Balancer {
+	return &weighted{current: make(map[string]map[string]int)}
+}
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[string]map[string]int
+}
+
+func (b *weighted) Balance(req BalanceRequest) []Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, ok := b.current[req.Method]
+	if !ok {
+		current = make(map[string]int)
+		b.current[req.Method] = current
+	}
+	for url := range current {
+		if !hasBackend(req.Backends, url) {
+			delete(current, url)
+		}
+	}
+
+	total, best := 0, 0
+	for i, backend := range req.Backends {
+		weight := backend.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		current[backend.Url] += weight
+		total += weight
+		if current[backend.Url] > current[req.Backends[best].Url] {
+			best = i
+		}
+	}
+	current[req.Backends[best].Url] -= total
+
+	return rotate(req.Backends, best)
+}
+
+func (b *weighted) forget(method string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.current, method)
+}
+
+// hasBackend reports whether the backends contain the backend at url.
+func hasBackend(backends []Backend, url string) bool {
+	for _, backend := range backends {
+		if backend.Url == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConsistentHash returns a balancer that sends the calls to a method with the same
+// value of the param to the same backend, using rendezvous hashing so that few
+// calls move when backends are added or removed. The param is read by name from
+// named params, and from positional params if it is the position of the param.
+// Calls without the param are balanced as if its value were null.
+func ConsistentHash(param string) Balancer {
+	return &consistentHash{param: param}
+}
+
+type consistentHash struct {
+	param string
+}
+
+func (b *consistentHash) Balance(req BalanceRequest) []Backend {
+	key := b.key(req.Params)
+	scores := make(map[string]uint64, len(req.Backends))
+	for _, backend := range req.Backends {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write([]byte{0})
+		h.Write([]byte(backend.Url))
+		scores[backend.Url] = h.Sum64()
+	}
+
+	backends := append([]Backend(nil), req.Backends...)
+	sort.SliceStable(backends, func(i, j int) bool {
+		return scores[backends[i].Url] > scores[backends[j].Url]
+	})
+
+	return backends
+}
+
+// key returns the compact json encoding of the hashed param value.
+func (b *consistentHash) key(params json.RawMessage) []byte {
+	var value json.RawMessage
+	raw := bytes.TrimSpace(params)
+	if len(raw) > 0 && raw[0] == '{' {
+		var named map[string]json.RawMessage
+		if json.Unmarshal(raw, &named) == nil {
+			value = named[b.param]
+		}
+	} else if pos, err := strconv.Atoi(b.param); err == nil && len(raw) > 0 && raw[0] == '[' {
+		var positional []json.RawMessage
+		if json.Unmarshal(raw, &positional) == nil && pos >= 0 && pos < len(positional) {
+			value = positional[pos]
+		}
+	}
+
+	var key bytes.Buffer
+	if len(value) == 0 || json.Compact(&key, value) != nil {
+		return []byte("null")
+	}
+
+	return key.Bytes()
+}
+
+// rotate returns a copy of the backends starting at index i.
+func rotate(backends []Backend, i int) []Backend {
+	rotated := make([]Backend, 0, len(backends))
+	rotated = append(rotated, backends[i:]...)
+
+	return append(rotated, backends[:i]...)
+}
+
+// backends returns the backends of a proxied method, or nil if the method is
+// called locally.
+func (m MethodWithContext) backends() []Backend {
+	if m.Method != nil {
+		return nil
+	}
+	if len(m.Backends) > 0 {
+		return m.Backends
+	}
+	if m.Url != "" {
+		return []Backend{{Url: m.Url}}
+	}
+
+	return nil
+}
+
+// backendInFlight returns the number of proxied calls in flight to the backend at url.
+func (s *Server) backendInFlight(url string) int {
+	if n, ok := s.backendCalls.Load(url); ok {
+		return int(atomic.LoadInt64(n.(*int64)))
+	}
+
+	return 0
+}
+
+// trackBackendCall counts a proxied call in flight to the backend at url until
+// the returned function is called.
+func (s *Server) trackBackendCall(url string) func() {
+	n, _ := s.backendCalls.LoadOrStore(url, new(int64))
+	atomic.AddInt64(n.(*int64), 1)
+
+	return func() { atomic.AddInt64(n.(*int64), -1) }
+}
+
+// balancerChanged drops the balancer state of unregistered methods.
+func (s *Server) balancerChanged(event RegistryEvent) {
+	if event.Type != MethodUnregistered {
+		return
+	}
+	for _, balancer := range []Balancer{event.Method.Balancer, s.Balancer, s.defaultBalancer} {
+		if f, ok := balancer.(methodForgetter); ok {
+			f.forget(event.Name)
+		}
+	}
+}
+
+// callProxied calls the method on its backends. Expired backends are removed,
+// unhealthy backends and backends with an open circuit are skipped and the
+// remaining backends are tried in the order chosen by the balancer.
+func (s *Server) callProxied(ctx context.Context, name string, method MethodWithContext, params json.RawMessage) (interface{}, *ErrorObject) {
+	var available []Backend
+	registered, open := false, false
+	for _, backend := range method.backends() {
+		if s.health.expired(name, backend.Url) && s.removeProxied(name, backend.Url) {
+			continue
+		}
+		registered = true
+		if !s.health.healthy(backend.Url) {
+			continue
+		}
+		if s.circuitOpen(backend.Url) {
+			open = true
+			continue
+		}
+		available = append(available, backend)
+	}
+	if !registered {
+		return nil, &ErrorObject{
+			Code:    MethodNotFoundCode,
+			Message: MethodNotFoundMsg,
+		}
+	}
+	if len(available) == 0 && open {
+		return nil, &ErrorObject{
+			Code:    CircuitOpenCode,
+			Message: CircuitOpenMsg,
+		}
+	}
+	if len(available) == 0 {
+		return nil, &ErrorObject{
+			Code:    BackendUnavailableCode,
+			Message: BackendUnavailableMsg,
+		}
+	}
+
+	balancer := method.Balancer
+	if balancer == nil {
+		balancer = s.Balancer
+	}
+	if balancer == nil {
+		balancer = s.defaultBalancer
+	}
+	order := balancer.Balance(BalanceRequest{
+		Method:   name,
+		Params:   params,
+		Backends: available,
+		InFlight: s.backendInFlight,
+	})
+
+	if len(order) == 0 {
+		return nil, &ErrorObject{
+			Code:    BackendUnavailableCode,
+			Message: BackendUnavailableMsg,
+		}
+	}
+
+	return s.forward(ctx, s.proxyConfig(method), name, order, params)
+}
@@ -0,0 +1,193 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// newBalanceTestBackend creates a backend that answers the whoami method with its
+// name and fails the fail method. The options further configure the backend.
+func newBalanceTestBackend(t *testing.T, name string, options ...func(ts *testServer)) *httptest.Server {
+	methods := func(ts *testServer) {
+		ts.RegisterWithContext("whoami", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				return name, nil
+			},
+		})
+		ts.RegisterWithContext("fail", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				return nil, &ErrorObject{Code: -32050, Message: ServerErrorMsg, Data: name}
+			},
+		})
+	}
+
+	return newTestServer(t, append([]func(ts *testServer){methods}, options...)...).srv
+}
+
+// callWhoami calls the whoami method n times and returns the names of the backends
+// that answered.
+func callWhoami(t *testing.T, c *Client, n int, params interface{}) []string {
+	names := make([]string, n)
+	for i := range names {
+		if err := c.Call(context.Background(), "whoami", params, &names[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return names
+}
+
+// registerBackends registers the whoami and fail methods of the backends with
+// decreasing weights.
+func registerBackends(t *testing.T, c *Client, backends ...*httptest.Server) {
+	for i, backend := range backends {
+		for _, method := range []string{"whoami", "fail"} {
+			params := []interface{}{method, backend.URL + "/rpc", nil, 3 - 2*i}
+			if err := c.Call(context.Background(), "jrpc2.register", params, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRegisterMultipleBackends(t *testing.T) {
+	a, b := newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b")
+	s := newTestServer(t)
+	s.Register("local", Method{Method: Sum})
+	c := s.client
+	registerBackends(t, c, a, b)
+
+	table := [][]interface{}{
+		{"whoami", a.URL + "/rpc"},
+		{"local", a.URL + "/rpc"},
+	}
+	for _, params := range table {
+		err := c.Call(context.Background(), "jrpc2.register", params, nil)
+		if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != MethodExistsCode {
+			t.Fatalf("Expected method exists error for %v, got %v", params, err)
+		}
+	}
+
+	if names := callWhoami(t, c, 4, nil); names[0] == names[1] || names[0] != names[2] || names[1] != names[3] {
+		t.Fatalf("Expected round-robin between backends, got %v", names)
+	}
+
+	if err := c.Call(context.Background(), "jrpc2.unregister", []string{"whoami", a.URL + "/rpc"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range callWhoami(t, c, 2, nil) {
+		if name != "b" {
+			t.Fatalf("Expected remaining backend b, got %s", name)
+		}
+	}
+	if err := c.Call(context.Background(), "jrpc2.unregister", []string{"whoami", b.URL + "/rpc"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Lookup("whoami"); ok {
+		t.Fatal("Expected method without backends to be unregistered")
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	c := newTestServer(t, func(ts *testServer) { ts.Balancer = Weighted() }).client
+	registerBackends(t, c, newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b"))
+
+	names := callWhoami(t, c, 8, nil)
+	expected := []string{"a", "a", "b", "a", "a", "a", "b", "a"}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected weighted sequence %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestWeightedBalancerState(t *testing.T) {
+	b := Weighted().(*weighted)
+	b.Balance(BalanceRequest{Method: "m", Backends: []Backend{{Url: "http://a"}, {Url: "http://b"}}})
+	b.Balance(BalanceRequest{Method: "m", Backends: []Backend{{Url: "http://b"}}})
+	if current := b.current["m"]; len(current) != 1 {
+		t.Fatalf("Expected state of removed backend to be dropped, got %v", current)
+	}
+
+	s := NewServer("", "/rpc", nil)
+	s.Balancer = b
+	s.Register("m", Method{Url: "http://b"})
+	s.Unregister("m")
+	if _, ok := b.current["m"]; ok {
+		t.Fatal("Expected state of unregistered method to be dropped")
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	c := newTestServer(t, func(ts *testServer) { ts.Balancer = ConsistentHash("user") }).client
+	registerBackends(t, c, newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b"))
+
+	seen := make(map[string]bool)
+	for _, user := range []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"} {
+		names := callWhoami(t, c, 3, map[string]string{"user": user})
+		if names[0] != names[1] || names[0] != names[2] {
+			t.Fatalf("Expected calls of %s to go to the same backend, got %v", user, names)
+		}
+		seen[names[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("Expected users to be spread over both backends, got %v", seen)
+	}
+
+	b := ConsistentHash("0")
+	backends := []Backend{{Url: "http://a"}, {Url: "http://b"}, {Url: "http://c"}}
+	named := b.Balance(BalanceRequest{Method: "m", Params: json.RawMessage(`{"0": "k"}`), Backends: backends})
+	positional := b.Balance(BalanceRequest{Method: "m", Params: json.RawMessage(`[ "k" ]`), Backends: backends})
+	if named[0] != positional[0] || len(positional) != 3 {
+		t.Fatalf("Expected named and positional keys to match, got %v %v", named, positional)
+	}
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	inFlight := map[string]int{"http://a": 2, "http://b": 0, "http://c": 1}
+	req := BalanceRequest{
+		Method:   "m",
+		Backends: []Backend{{Url: "http://a"}, {Url: "http://b"}, {Url: "http://c"}},
+		InFlight: func(url string) int { return inFlight[url] },
+	}
+
+	order := LeastInFlight().Balance(req)
+	if order[0].Url != "http://b" || order[1].Url != "http://c" || order[2].Url != "http://a" {
+		t.Fatalf("Unexpected order %v", order)
+	}
+}
+
+func TestBalancerFailover(t *testing.T) {
+	a, b := newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b")
+	c := newTestServer(t).client
+	registerBackends(t, c, a, b)
+
+	backends := make(map[interface{}]bool)
+	for i := 0; i < 2; i++ {
+		err := c.Call(context.Background(), "fail", nil, nil)
+		if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != -32050 {
+			t.Fatalf("Expected backend error, got %v", err)
+		} else {
+			backends[errObj.Data] = true
+		}
+	}
+	if len(backends) != 2 {
+		t.Fatalf("Expected backend errors to be returned without failover, got %v", backends)
+	}
+
+	a.Close()
+	for _, name := range callWhoami(t, c, 4, nil) {
+		if name != "b" {
+			t.Fatalf("Expected failover to backend b, got %s", name)
+		}
+	}
+
+	b.Close()
+	err := c.Call(context.Background(), "whoami", nil, nil)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("Expected backend unavailable error when no backend can be reached, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatchAddResponseConcurrent(t *testing.T) {
+	batch := new(Batch)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batch.AddResponse([]byte(fmt.Sprint(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	if len(batch.Responses) != 100 {
+		t.Fatalf("Expected 100 responses, got %d", len(batch.Responses))
+	}
+}
+
+// newBatchRequest creates a batch of sleep requests with decreasing durations.
+func newBatchRequest(n int) []byte {
+	reqs := make([]string, n)
+	for i := range reqs {
+		reqs[i] = fmt.Sprintf(`{"jsonrpc": "2.0", "method": "sleep", "params": [%d], "id": %d}`, (n-i)*5, i)
+	}
+
+	return []byte("[" + strings.Join(reqs, ",") + "]")
+}
+
+// postBatch posts the body to the rpc route at url and returns the response body.
+func postBatch(t *testing.T, url string, body []byte) []byte {
+	resp, err := http.Post(url, "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// withSleep registers the sleep method, which sleeps for the milliseconds of its
+// param and tracks the running and peak number of calls.
+func withSleep(running, peak *int32) func(ts *testServer) {
+	return func(ts *testServer) {
+		ts.RegisterWithContext("sleep", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				var p []int
+				json.Unmarshal(params, &p)
+				n := atomic.AddInt32(running, 1)
+				for {
+					max := atomic.LoadInt32(peak)
+					if n <= max || atomic.CompareAndSwapInt32(peak, max, n) {
+						break
+					}
+				}
+				time.Sleep(time.Duration(p[0]) * time.Millisecond)
+				atomic.AddInt32(running, -1)
+				return p[0], nil
+			},
+		})
+	}
+}
+
+func TestOrderedBatch(t *testing.T) {
+	var running, peak int32
+	s := newTestServer(t, withSleep(&running, &peak), func(ts *testServer) { ts.OrderedBatch = true })
+
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(postBatch(t, s.url, newBatchRequest(10)), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 10 {
+		t.Fatalf("Expected 10 responses, got %d", len(resps))
+	}
+	for i, resp := range resps {
+		if resp.Id != i {
+			t.Fatalf("Expected response %d to have id %d, got %d", i, i, resp.Id)
+		}
+	}
+}
+
+func TestMaxBatchParallelism(t *testing.T) {
+	var running, peak int32
+	s := newTestServer(t, withSleep(&running, &peak), func(ts *testServer) { ts.MaxBatchParallelism = 2 })
+
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(postBatch(t, s.url, newBatchRequest(6)), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 6 {
+		t.Fatalf("Expected 6 responses, got %d", len(resps))
+	}
+	if peak := atomic.LoadInt32(&peak); peak > 2 {
+		t.Fatalf("Expected at most 2 parallel calls, got %d", peak)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	var running, peak int32
+	s := newTestServer(t, withSleep(&running, &peak), func(ts *testServer) { ts.MaxBatchSize = 3 })
+
+	var resp JsonRpcResponse
+	if err := json.Unmarshal(postBatch(t, s.url, newBatchRequest(4)), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Err == nil || resp.Err.Code != InvalidRequestCode {
+		t.Fatalf("Expected invalid request error, got %+v", resp)
+	}
+	if running != 0 || peak != 0 {
+		t.Fatal("Expected no batch requests to be called")
+	}
+
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(postBatch(t, s.url, newBatchRequest(3)), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 3 {
+		t.Fatalf("Expected 3 responses, got %d", len(resps))
+	}
+}
+
+func TestStreamBatch(t *testing.T) {
+	release := make(chan struct{})
+	s := newTestServer(t, withSum, withWait(release), func(ts *testServer) { ts.StreamBatch = true })
+
+	body := `[
+        {"jsonrpc": "2.0", "method": "wait", "id": 1},
+        {"jsonrpc": "2.0", "method": "sum", "params": [1, 2]},
+        {"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 2}
+    ]`
+	resp, err := http.Post(s.url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Expected chunked transfer encoding, got %v", resp.TransferEncoding)
+	}
+
+	first := make([]byte, len(`[{"jsonrpc":"2.0","result":3,"id":2}`))
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != `[{"jsonrpc":"2.0","result":3,"id":2}` {
+		t.Fatalf("Expected sum response to be streamed first, got %s", first)
+	}
+
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(append(first, rest...), &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 2 || resps[1].Id != 1 || resps[1].Result != "done" {
+		t.Fatalf("Unexpected batch response %+v", resps)
+	}
+}
+
+func TestStreamBatchOrdered(t *testing.T) {
+	var running, peak int32
+	s := newTestServer(t, withSleep(&running, &peak), func(ts *testServer) {
+		ts.StreamBatch = true
+		ts.OrderedBatch = true
+	})
+
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(postBatch(t, s.url, newBatchRequest(5)), &resps); err != nil {
+		t.Fatal(err)
+	}
+	for i, resp := range resps {
+		if resp.Id != i {
+			t.Fatalf("Expected response %d to have id %d, got %d", i, i, resp.Id)
+		}
+	}
+	if len(resps) != 5 {
+		t.Fatalf("Expected 5 responses, got %d", len(resps))
+	}
+
+	data := postBatch(t, s.url, []byte(`[{"jsonrpc": "2.0", "method": "sleep", "params": [1]}]`))
+	if len(data) != 0 {
+		t.Fatalf("Expected empty response for notifications, got %s", data)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// DefaultCancelMethod is the default method name of cancellation notifications.
+const DefaultCancelMethod = "$/cancelRequest"
+
+// ErrRequestCancelled is the context cause of a request cancelled by the client.
+var ErrRequestCancelled = errors.New("jrpc2: request cancelled")
+
+// CancelParams is a parameter spec for the cancel method.
+type CancelParams struct {
+	// Id is the id of the request to cancel.
+	Id interface{} `json:"id" jrpc:"pos=0,required"`
+}
+
+// inflightRequest is a request being handled on a persistent connection.
+type inflightRequest struct {
+	cancel context.CancelCauseFunc
+}
+
+// inflight tracks the requests being handled on a persistent connection by id.
+type inflight struct {
+	mu   sync.Mutex
+	reqs map[string]*inflightRequest
+}
+
+// track returns a cancellable context for the request with the given id, and a
+// function that stops tracking the request once it is handled. Notifications
+// are not tracked.
+func (f *inflight) track(ctx context.Context, id interface{}) (context.Context, func()) {
+	if id == nil {
+		return ctx, func() {}
+	}
+
+	key, err := json.Marshal(id)
+	if err != nil {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	req := &inflightRequest{cancel: cancel}
+
+	f.mu.Lock()
+	if f.reqs == nil {
+		f.reqs = make(map[string]*inflightRequest)
+	}
+	f.reqs[string(key)] = req
+	f.mu.Unlock()
+
+	return ctx, func() {
+		f.mu.Lock()
+		if f.reqs[string(key)] == req {
+			delete(f.reqs, string(key))
+		}
+		f.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancel cancels the in flight request with the given id and reports whether
+// the request was found.
+func (f *inflight) cancel(id interface{}) bool {
+	key, err := json.Marshal(id)
+	if err != nil {
+		return false
+	}
+
+	f.mu.Lock()
+	req, ok := f.reqs[string(key)]
+	f.mu.Unlock()
+	if ok {
+		req.cancel(ErrRequestCancelled)
+	}
+
+	return ok
+}
+
+// CancelRequest cancels the context of a request in flight on the same
+// connection. The cancelled request is answered with a RequestCancelledCode
+// error. Requests are only cancellable over persistent connections.
+func (s *Server) CancelRequest(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	p := new(CancelParams)
+	if err := ParseParams(params, p); err != nil {
+		return nil, err
+	}
+
+	peer, ok := PeerFromContext(ctx)
+	if !ok {
+		return nil, &ErrorObject{
+			Code:    InvalidRequestCode,
+			Message: InvalidRequestMsg,
+			Data:    "requests can only be cancelled over a persistent connection",
+		}
+	}
+
+	return peer.inflight.cancel(p.Id), nil
+}
+
+// cancelledError returns the error response of a request cancelled by the
+// client, or nil if the request was not cancelled.
+func cancelledError(ctx context.Context) *ErrorObject {
+	if ctx == nil || !errors.Is(context.Cause(ctx), ErrRequestCancelled) {
+		return nil
+	}
+
+	return &ErrorObject{
+		Code:    RequestCancelledCode,
+		Message: RequestCancelledMsg,
+	}
+}
@@ -0,0 +1,93 @@
+package jrpc2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// withCancellableWait registers the wait method, which signals started and answers
+// once the call is cancelled.
+func withCancellableWait(started chan struct{}) func(ts *testServer) {
+	return func(ts *testServer) {
+		ts.RegisterWithContext("wait", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				started <- struct{}{}
+				<-ctx.Done()
+				return "done", nil
+			},
+		})
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	started := make(chan struct{}, 1)
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newTestServer(t, withSum, withCancellableWait(started)).ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "wait", "id": "w1"}` + "\n"))
+	<-started
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": "w1"}}` + "\n"))
+
+	resp := readMessage(t, client, rdr)
+	errObj, _ := resp["error"].(map[string]interface{})
+	if resp["id"] != "w1" || errObj["code"] != float64(RequestCancelledCode) || errObj["message"] != string(RequestCancelledMsg) {
+		t.Fatalf("Expected request cancelled error, got %v", resp)
+	}
+}
+
+func TestCancelBatchRequest(t *testing.T) {
+	started := make(chan struct{}, 1)
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := newTestServer(t, withSum, withCancellableWait(started), func(ts *testServer) { ts.CancelMethod = "cancel" })
+	go s.ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`[{"jsonrpc": "2.0", "method": "wait", "id": 5}, {"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 6}]` + "\n"))
+	<-started
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "cancel", "params": [5], "id": 7}` + "\n"))
+
+	resp := readMessage(t, client, rdr)
+	if resp["id"] != 7.0 || resp["result"] != true {
+		t.Fatalf("Expected cancel call to report the cancelled request, got %v", resp)
+	}
+
+	client.SetReadDeadline(testDeadline())
+	line, err := rdr.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch []JsonRpcResponse
+	if err := json.Unmarshal(line, &batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range batch {
+		switch r.Id {
+		case 5:
+			if r.Err == nil || r.Err.Code != RequestCancelledCode {
+				t.Fatalf("Expected request cancelled error, got %+v", r)
+			}
+		case 6:
+			if r.Result != 3.0 {
+				t.Fatalf("Expected sum result, got %+v", r)
+			}
+		}
+	}
+}
+
+func TestCancelUnknownRequest(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newTestServer(t, withSum, withCancellableWait(nil)).ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": {"id": 99}, "id": 1}` + "\n"))
+	if resp := readMessage(t, client, rdr); resp["result"] != false {
+		t.Fatalf("Expected unknown request to not be cancelled, got %v", resp)
+	}
+}
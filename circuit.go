@@ -0,0 +1,243 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of a backend.
+type CircuitState string
+
+const (
+	// CircuitClosed lets every call through to the backend.
+	// CircuitOpen fails the calls to the backend without calling it.
+	// CircuitHalfOpen lets trial calls through to the backend to decide whether
+	// the circuit closes again.
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreaker configures the circuit breakers of the backends of proxied
+// methods. The circuit of a backend opens after consecutive failed calls and
+// calls to the backend fail fast with CircuitOpenCode until the cool-down has
+// elapsed. A half-open circuit then lets trial calls through, and closes again
+// after a trial call succeeds or opens again after a trial call fails. Calls fail
+// when the backend can't be reached, doesn't answer in time or answers with a
+// bad response, and error objects returned by the backend don't count as failures.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failed calls after which the
+	// circuit opens, 5 if zero.
+	// CoolDown is the time an open circuit fails calls before it is half-open, 30
+	// seconds if zero.
+	// HalfOpenRequests is the number of trial calls a half-open circuit lets through
+	// at the same time, 1 if zero.
+	FailureThreshold int
+	CoolDown         time.Duration
+	HalfOpenRequests int
+}
+
+// CircuitStatus is the state of the circuit breaker of a backend.
+type CircuitStatus struct {
+	// Url is the url of the backend.
+	// State is the state of the circuit.
+	// Failures is the number of consecutive failed calls.
+	// OpenedAt is the time the circuit last opened, zero if never opened.
+	Url      string       `json:"url"`
+	State    CircuitState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt time.Time    `json:"openedAt"`
+}
+
+// circuit is the circuit breaker of a backend.
+type circuit struct {
+	status CircuitStatus
+	trials int
+}
+
+// circuitBreakers tracks the circuits of backends.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// newCircuitBreakers creates circuit breakers with every circuit closed.
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{circuits: make(map[string]*circuit)}
+}
+
+// get returns the circuit of the backend at url. It must be called with the lock
+// held.
+func (b *circuitBreakers) get(url string) *circuit {
+	c, ok := b.circuits[url]
+	if !ok {
+		c = &circuit{status: CircuitStatus{Url: url, State: CircuitClosed}}
+		b.circuits[url] = c
+	}
+
+	return c
+}
+
+// open reports whether the circuit of the backend at url is open and its cool-down
+// hasn't elapsed.
+func (b *circuitBreakers) open(config CircuitBreaker, url string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[url]
+	return ok && c.status.State == CircuitOpen && time.Since(c.status.OpenedAt) < config.CoolDown
+}
+
+// allow reports whether a call to the backend at url is let through. An open
+// circuit whose cool-down has elapsed becomes half-open.
+func (b *circuitBreakers) allow(config CircuitBreaker, url string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.get(url)
+	if c.status.State == CircuitOpen {
+		if time.Since(c.status.OpenedAt) < config.CoolDown {
+			return false
+		}
+		c.status.State, c.trials = CircuitHalfOpen, 0
+	}
+	if c.status.State == CircuitHalfOpen {
+		if c.trials >= config.HalfOpenRequests {
+			return false
+		}
+		c.trials++
+	}
+
+	return true
+}
+
+// record records the outcome of a call let through to the backend at url.
+func (b *circuitBreakers) record(config CircuitBreaker, url string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.get(url)
+	switch {
+	case !failed:
+		c.status.State, c.status.Failures = CircuitClosed, 0
+	case c.status.State == CircuitHalfOpen:
+		c.status.Failures++
+		c.status.State, c.status.OpenedAt = CircuitOpen, time.Now()
+	case c.status.State == CircuitClosed:
+		c.status.Failures++
+		if c.status.Failures >= config.FailureThreshold {
+			c.status.State, c.status.OpenedAt = CircuitOpen, time.Now()
+		}
+	}
+}
+
+// release ends a call let through to the backend at url without an outcome, such
+// as a call cancelled by the client.
+func (b *circuitBreakers) release(url string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c := b.get(url); c.status.State == CircuitHalfOpen && c.trials > 0 {
+		c.trials--
+	}
+}
+
+// circuitBreaker returns the circuit breaker configuration of the server with its
+// defaults applied, and false if circuit breaking is disabled.
+func (s *Server) circuitBreaker() (CircuitBreaker, bool) {
+	if s.CircuitBreaker == nil {
+		return CircuitBreaker{}, false
+	}
+
+	config := *s.CircuitBreaker
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 5
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = 30 * time.Second
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+
+	return config, true
+}
+
+// circuitOpen reports whether calls to the backend at url fail fast.
+func (s *Server) circuitOpen(url string) bool {
+	config, ok := s.circuitBreaker()
+	return ok && s.circuits.open(config, url)
+}
+
+// guardCall checks that the circuit of the backend at url lets a call through,
+// and returns the function that records the outcome of the call.
+func (s *Server) guardCall(ctx context.Context, url string) (func(err error), error) {
+	config, ok := s.circuitBreaker()
+	if !ok {
+		return func(error) {}, nil
+	}
+	if !s.circuits.allow(config, url) {
+		return nil, fmt.Errorf("jrpc2: circuit open for %s: %w", url, ErrCircuitOpen)
+	}
+
+	return func(err error) {
+		var errObj *ErrorObject
+		if err != nil && ctx.Err() != nil {
+			s.circuits.release(url)
+			return
+		}
+		s.circuits.record(config, url, err != nil && !errors.As(err, &errObj))
+	}, nil
+}
+
+// Circuits returns the state of the circuit breakers of the backends of the
+// proxied methods, sorted by url.
+func (s *Server) Circuits() []CircuitStatus {
+	urls := s.backendUrls()
+
+	s.circuits.mu.Lock()
+	defer s.circuits.mu.Unlock()
+
+	circuits := make([]CircuitStatus, 0, len(urls))
+	for url := range urls {
+		status := CircuitStatus{Url: url, State: CircuitClosed}
+		if c, ok := s.circuits.circuits[url]; ok {
+			status = c.status
+		}
+		circuits = append(circuits, status)
+	}
+	sort.Slice(circuits, func(i, j int) bool { return circuits[i].Url < circuits[j].Url })
+
+	return circuits
+}
+
+// CircuitsRPC returns the state of the circuit breakers of the backends of the
+// proxied methods.
+func (s *Server) CircuitsRPC(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	return s.Circuits(), nil
+}
@@ -0,0 +1,143 @@
+package jrpc2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withCircuitBreaker sets the circuit breaker configuration of the test server.
+func withCircuitBreaker(config CircuitBreaker) func(ts *testServer) {
+	return func(ts *testServer) { ts.CircuitBreaker = &config }
+}
+
+// callCircuit calls the method and returns the error code, or zero if the call
+// succeeded.
+func callCircuit(t *testing.T, c *Client, method string) ErrorCode {
+	err := c.Call(context.Background(), method, nil, nil)
+	if err == nil {
+		return 0
+	}
+	errObj, ok := err.(*ErrorObject)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	return errObj.Code
+}
+
+// circuitState returns the state of the circuit of the backend at url.
+func circuitState(t *testing.T, c *Client, url string) CircuitState {
+	var circuits []CircuitStatus
+	if err := c.Call(context.Background(), "jrpc2.circuits", nil, &circuits); err != nil {
+		t.Fatal(err)
+	}
+	for _, circuit := range circuits {
+		if circuit.Url == url {
+			return circuit.State
+		}
+	}
+	t.Fatalf("Expected circuit for %s, got %v", url, circuits)
+
+	return ""
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls, failing int64 = 0, 1
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		atomic.AddInt64(&calls, 1)
+		if atomic.LoadInt64(&failing) == 1 {
+			return http.StatusInternalServerError, nil
+		}
+		return http.StatusOK, "ok"
+	})
+	c := newTestServer(t, withCircuitBreaker(CircuitBreaker{FailureThreshold: 2, CoolDown: 50 * time.Millisecond}), withProxied(backend.URL, "echo")).client
+
+	if state := circuitState(t, c, backend.URL); state != CircuitClosed {
+		t.Fatalf("Expected closed circuit, got %s", state)
+	}
+	for i := 0; i < 2; i++ {
+		if code := callCircuit(t, c, "echo"); code != BackendErrorCode {
+			t.Fatalf("Expected backend error, got %d", code)
+		}
+	}
+	if code := callCircuit(t, c, "echo"); code != CircuitOpenCode {
+		t.Fatalf("Expected circuit open error, got %d", code)
+	}
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Fatalf("Expected open circuit to fail fast, got %d backend calls", n)
+	}
+	if state := circuitState(t, c, backend.URL); state != CircuitOpen {
+		t.Fatalf("Expected open circuit, got %s", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if code := callCircuit(t, c, "echo"); code != BackendErrorCode {
+		t.Fatalf("Expected trial call to reach the backend, got %d", code)
+	}
+	if code := callCircuit(t, c, "echo"); code != CircuitOpenCode {
+		t.Fatalf("Expected failed trial call to open the circuit, got %d", code)
+	}
+
+	atomic.StoreInt64(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	if code := callCircuit(t, c, "echo"); code != 0 {
+		t.Fatalf("Expected trial call to succeed, got %d", code)
+	}
+	if state := circuitState(t, c, backend.URL); state != CircuitClosed {
+		t.Fatalf("Expected closed circuit, got %s", state)
+	}
+}
+
+func TestCircuitBreakerErrorObjects(t *testing.T) {
+	backend := newBalanceTestBackend(t, "a")
+	c := newTestServer(t, withCircuitBreaker(CircuitBreaker{FailureThreshold: 1}), withProxied(backend.URL+"/rpc", "fail")).client
+
+	for i := 0; i < 3; i++ {
+		if code := callCircuit(t, c, "fail"); code != -32050 {
+			t.Fatalf("Expected backend error object, got %d", code)
+		}
+	}
+}
+
+func TestCircuitBreakerFailover(t *testing.T) {
+	a, b := newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b")
+	c := newTestServer(t, withCircuitBreaker(CircuitBreaker{FailureThreshold: 1, CoolDown: time.Minute})).client
+	registerBackends(t, c, a, b)
+	a.Close()
+
+	for _, name := range callWhoami(t, c, 4, nil) {
+		if name != "b" {
+			t.Fatalf("Expected calls to fail over to backend b, got %s", name)
+		}
+	}
+	if state := circuitState(t, c, a.URL+"/rpc"); state != CircuitOpen {
+		t.Fatalf("Expected open circuit for backend a, got %s", state)
+	}
+
+	b.Close()
+	if code := callCircuit(t, c, "whoami"); code != BackendUnavailableCode {
+		t.Fatalf("Expected backend unavailable error, got %d", code)
+	}
+	if code := callCircuit(t, c, "whoami"); code != CircuitOpenCode {
+		t.Fatalf("Expected circuit open error, got %d", code)
+	}
+}
+
+func TestCircuitOpenError(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	s.CircuitBreaker = &CircuitBreaker{FailureThreshold: 1, CoolDown: time.Minute}
+	config, _ := s.circuitBreaker()
+	s.circuits.record(config, "http://backend", true)
+
+	_, err := s.guardCall(context.Background(), "http://backend")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected circuit open error, got %v", err)
+	}
+	if errObj := s.proxyError(context.Background(), err); errObj.Code != CircuitOpenCode || errObj == ErrCircuitOpen {
+		t.Fatalf("Expected new circuit open error object, got %v", errObj)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrEmptyResponse is returned when a call receives no response body.
+var ErrEmptyResponse = errors.New("jrpc2: empty response")
+
+// TransportError reports a failure to deliver a request to the server or to
+// receive its response, as opposed to an error object returned by the server.
+type TransportError struct {
+	// StatusCode is the http status code of the response, zero if no response
+	// was received.
+	// Err is the underlying error.
+	StatusCode int
+	Err        error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// clientRequest is the wire representation of an outbound request object.
+// Unlike RequestObject, absent params and ids are omitted so that
+// notifications are encoded as the specification requires.
+type clientRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      interface{}     `json:"id,omitempty"`
+}
+
+// clientResponse is the wire representation of an inbound response object.
+// The result is kept raw so it can be decoded into the caller's type.
+type clientResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Error   *ErrorObject    `json:"error"`
+	Result  json.RawMessage `json:"result"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// Error returns the error object as a string, satisfying the error interface.
+func (e *ErrorObject) Error() string {
+	if e.Data != nil {
+		return fmt.Sprintf("jrpc2: %s (%d): %v", e.Message, e.Code, e.Data)
+	}
+	return fmt.Sprintf("jrpc2: %s (%d)", e.Message, e.Code)
+}
+
+// Client is a json rpc 2.0 client for calling jrpc2 servers over http.
+type Client struct {
+	// Url is the url of the rpc server.
+	// Headers contains request headers sent with every call.
+	// HTTPClient is the http client used to send requests. If nil,
+	// http.DefaultClient is used.
+	Url        string
+	Headers    map[string]string
+	HTTPClient *http.Client
+	id         uint64
+}
+
+// NewClient creates a new client instance for the server at url.
+func NewClient(url string, headers map[string]string) *Client {
+	return &Client{Url: url, Headers: headers}
+}
+
+// Call invokes the named method with the provided params and decodes the
+// call result into result. Params may be any value that encodes to a json
+// array or object, or nil to omit params. If result is nil the call result is
+// discarded. Errors returned by the server are returned as *ErrorObject.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := c.nextId()
+	body, err := newRequest(method, params, id)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.post(ctx, body)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return ErrEmptyResponse
+	}
+
+	resp := new(clientResponse)
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("jrpc2: decoding response: %w", err)
+	}
+
+	return resp.decode(id, result)
+}
+
+// Notify invokes the named method with the provided params as a notification.
+// The server sends no response to a notification.
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	body, err := newRequest(method, params, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.post(ctx, body)
+
+	return err
+}
+
+// nextId returns the next unique request id for the client.
+func (c *Client) nextId() uint64 {
+	return atomic.AddUint64(&c.id, 1)
+}
+
+// newRequest creates a bytes encoded representation of a request object.
+// A nil id creates a notification.
+func newRequest(method string, params interface{}, id interface{}) ([]byte, error) {
+	raw, err := marshalParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &clientRequest{
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  raw,
+	}
+	if id != nil {
+		req.Id = id
+	}
+
+	return json.Marshal(req)
+}
+
+// post sends the request body to the server and returns the response body.
+func (c *Client) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for header, value := range c.Headers {
+		req.Header.Set(header, value)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &TransportError{StatusCode: resp.StatusCode, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &TransportError{
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("jrpc2: unexpected http status %s", resp.Status),
+		}
+	}
+
+	return data, nil
+}
+
+// decode returns the response error or decodes the response result into
+// result. The response id must match the provided request id.
+func (r *clientResponse) decode(id interface{}, result interface{}) error {
+	if r.Error != nil {
+		return r.Error
+	}
+
+	want, _ := json.Marshal(id)
+	if !bytes.Equal(bytes.TrimSpace(r.Id), want) {
+		return fmt.Errorf("jrpc2: response id %s does not match request id %s", r.Id, want)
+	}
+
+	if result == nil || len(r.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("jrpc2: decoding result: %w", err)
+	}
+
+	return nil
+}
+
+// marshalParams encodes the params value of a request.
+// A nil params value or empty raw message is omitted from the request.
+func marshalParams(params interface{}) (json.RawMessage, error) {
+	switch p := params.(type) {
+	case nil:
+		return nil, nil
+	case json.RawMessage:
+		if len(p) == 0 {
+			return nil, nil
+		}
+		return p, nil
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("jrpc2: encoding params: %w", err)
+	}
+
+	return raw, nil
+}
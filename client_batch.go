@@ -0,0 +1,178 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrEmptyBatch is returned when sending a batch with no queued requests.
+	ErrEmptyBatch = errors.New("jrpc2: batch contains no requests")
+	// ErrBatchSent is returned when sending a batch more than once.
+	ErrBatchSent = errors.New("jrpc2: batch already sent")
+	// ErrBatchPending is returned by a batch call that has not been sent.
+	ErrBatchPending = errors.New("jrpc2: batch not sent")
+	// ErrNoResponse is returned by a batch call the server did not respond to.
+	ErrNoResponse = errors.New("jrpc2: no response for call")
+)
+
+// BatchCall is the pending result of a call queued in a ClientBatch.
+type BatchCall struct {
+	// Method is the name of the called method.
+	Method string
+	id     uint64
+	result interface{}
+	err    error
+}
+
+// Err returns the error of the call once the batch is sent.
+// Errors returned by the server are returned as *ErrorObject.
+func (c *BatchCall) Err() error {
+	return c.err
+}
+
+// ClientBatch queues calls and notifications to be sent as a single batch
+// request.
+type ClientBatch struct {
+	client   *Client
+	requests []json.RawMessage
+	calls    []*BatchCall
+	err      error
+	sent     bool
+}
+
+// NewBatch creates a new empty batch for the client.
+func (c *Client) NewBatch() *ClientBatch {
+	return &ClientBatch{client: c}
+}
+
+// Call queues a call of the named method with the provided params.
+// The call result is decoded into result when the batch is sent.
+func (b *ClientBatch) Call(method string, params interface{}, result interface{}) *BatchCall {
+	call := &BatchCall{
+		Method: method,
+		id:     b.client.nextId(),
+		result: result,
+		err:    ErrBatchPending,
+	}
+	b.calls = append(b.calls, call)
+	b.add(method, params, call.id)
+
+	return call
+}
+
+// Notify queues a notification of the named method with the provided params.
+func (b *ClientBatch) Notify(method string, params interface{}) {
+	b.add(method, params, nil)
+}
+
+// Len returns the number of queued requests.
+func (b *ClientBatch) Len() int {
+	return len(b.requests)
+}
+
+// add encodes and queues a request. The first encoding error is kept and
+// returned when the batch is sent.
+func (b *ClientBatch) add(method string, params interface{}, id interface{}) {
+	body, err := newRequest(method, params, id)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	b.requests = append(b.requests, body)
+}
+
+// Send sends the queued requests as a single batch and correlates the
+// responses with the queued calls by id. Calls without a matching response
+// fail with ErrNoResponse. A batch level error, such as a server parse error,
+// is returned and set on every call.
+func (b *ClientBatch) Send(ctx context.Context) error {
+	if b.sent {
+		return ErrBatchSent
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.requests) == 0 {
+		return ErrEmptyBatch
+	}
+	b.sent = true
+
+	body, err := json.Marshal(b.requests)
+	if err != nil {
+		return b.fail(err)
+	}
+	data, err := b.client.post(ctx, body)
+	if err != nil {
+		return b.fail(err)
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		resp := new(clientResponse)
+		if err := json.Unmarshal(data, resp); err != nil {
+			return b.fail(fmt.Errorf("jrpc2: decoding response: %w", err))
+		}
+		if resp.Error != nil {
+			return b.fail(resp.Error)
+		}
+		data = append(append([]byte{'['}, data...), ']')
+	}
+
+	var resps []*clientResponse
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &resps); err != nil {
+			return b.fail(fmt.Errorf("jrpc2: decoding response: %w", err))
+		}
+	}
+
+	byId := make(map[string]*clientResponse, len(resps))
+	for _, resp := range resps {
+		if resp != nil {
+			byId[string(bytes.TrimSpace(resp.Id))] = resp
+		}
+	}
+	for _, call := range b.calls {
+		key, _ := json.Marshal(call.id)
+		if resp, ok := byId[string(key)]; ok {
+			call.err = resp.decode(call.id, call.result)
+		} else {
+			call.err = ErrNoResponse
+		}
+	}
+
+	return nil
+}
+
+// fail sets err on every queued call and returns it.
+func (b *ClientBatch) fail(err error) error {
+	for _, call := range b.calls {
+		call.err = err
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package jrpc2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCall(t *testing.T) {
+	c := NewClient("http://localhost:31500/api/v1/rpc", nil)
+
+	var result float64
+	if err := c.Call(context.Background(), "sum", []int{1, 2}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != 3 {
+		t.Fatalf("Expected result to be 3, got %v", result)
+	}
+
+	var diff int
+	params := map[string]int{"minuend": 42, "subtrahend": 23}
+	if err := c.Call(context.Background(), "subtract", params, &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff != 19 {
+		t.Fatalf("Expected result to be 19, got %v", diff)
+	}
+}
+
+func TestClientCallError(t *testing.T) {
+	c := NewClient("http://localhost:31500/api/v1/rpc", nil)
+
+	err := c.Call(context.Background(), "subtract", []int{999, 999}, nil)
+	var errObj *ErrorObject
+	if !errors.As(err, &errObj) {
+		t.Fatalf("Expected *ErrorObject, got %v", err)
+	}
+	if errObj.Code != -32001 || errObj.Data != "Mock error" {
+		t.Fatalf("Unexpected error object %+v", errObj)
+	}
+
+	err = c.Call(context.Background(), "fooba", nil, nil)
+	if !errors.As(err, &errObj) || errObj.Code != MethodNotFoundCode {
+		t.Fatalf("Expected method not found error, got %v", err)
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	c := NewClient("http://localhost:31500/api/v1/rpc", map[string]string{"user": "bob"})
+
+	var result string
+	if err := c.Call(context.Background(), "say", []string{"Hello"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != "Hello bob!" {
+		t.Fatalf("Unexpected result %q", result)
+	}
+}
+
+func TestClientNotify(t *testing.T) {
+	c := NewClient("https://localhost:31511/api/v4/rpc", nil)
+
+	if err := c.Notify(context.Background(), "update", []int{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCallNullResult(t *testing.T) {
+	c := NewClient("https://localhost:31511/api/v4/rpc", nil)
+
+	// the update method returns a nil result which the server omits
+	if err := c.Call(context.Background(), "update", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientBatch(t *testing.T) {
+	c := NewClient("http://localhost:31500/api/v1/rpc", nil)
+	b := c.NewBatch()
+
+	var sum, diff float64
+	sumCall := b.Call("sum", []int{1, 2}, &sum)
+	b.Notify("sum", []int{3, 4})
+	diffCall := b.Call("subtract", map[string]int{"minuend": 42, "subtrahend": 23}, &diff)
+	missingCall := b.Call("fooba", nil, nil)
+
+	if err := sumCall.Err(); err != ErrBatchPending {
+		t.Fatalf("Expected pending call error, got %v", err)
+	}
+	if err := b.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sumCall.Err(); err != nil || sum != 3 {
+		t.Fatalf("Unexpected sum call result %v, %v", sum, err)
+	}
+	if err := diffCall.Err(); err != nil || diff != 19 {
+		t.Fatalf("Unexpected subtract call result %v, %v", diff, err)
+	}
+	var errObj *ErrorObject
+	if err := missingCall.Err(); !errors.As(err, &errObj) || errObj.Code != MethodNotFoundCode {
+		t.Fatalf("Expected method not found error, got %v", err)
+	}
+
+	if err := b.Send(context.Background()); err != ErrBatchSent {
+		t.Fatalf("Expected batch sent error, got %v", err)
+	}
+}
+
+func TestClientBatchNoResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"jsonrpc": "2.0", "result": "ok", "id": 1}]`))
+	}))
+	defer srv.Close()
+
+	b := NewClient(srv.URL, nil).NewBatch()
+	var result string
+	first := b.Call("first", nil, &result)
+	second := b.Call("second", nil, nil)
+	if err := b.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Err(); err != nil || result != "ok" {
+		t.Fatalf("Unexpected first call result %v, %v", result, err)
+	}
+	if err := second.Err(); err != ErrNoResponse {
+		t.Fatalf("Expected no response error, got %v", err)
+	}
+}
+
+func TestClientBatchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`))
+	}))
+	defer srv.Close()
+
+	b := NewClient(srv.URL, nil).NewBatch()
+	call := b.Call("first", nil, nil)
+	err := b.Send(context.Background())
+
+	var errObj *ErrorObject
+	if !errors.As(err, &errObj) || errObj.Code != ParseErrorCode {
+		t.Fatalf("Expected parse error, got %v", err)
+	}
+	if call.Err() != err {
+		t.Fatalf("Expected call error to be the batch error, got %v", call.Err())
+	}
+}
+
+func TestClientBatchEmpty(t *testing.T) {
+	b := NewClient("http://localhost:31500/api/v1/rpc", nil).NewBatch()
+	if err := b.Send(context.Background()); err != ErrEmptyBatch {
+		t.Fatalf("Expected empty batch error, got %v", err)
+	}
+}
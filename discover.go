@@ -0,0 +1,171 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// DiscoverMethod is the name of the method that returns the OpenRPC document of
+// the server.
+const DiscoverMethod = "rpc.discover"
+
+// OpenRPCVersion is the version of the OpenRPC specification of the documents
+// returned by DiscoverMethod.
+const OpenRPCVersion = "1.2.6"
+
+// OpenRPCDocument is an OpenRPC document describing the methods of a server.
+type OpenRPCDocument struct {
+	OpenRPC string          `json:"openrpc"`
+	Info    OpenRPCInfo     `json:"info"`
+	Methods []OpenRPCMethod `json:"methods"`
+}
+
+// OpenRPCInfo provides metadata about the api of a server.
+type OpenRPCInfo struct {
+	// Title is the title of the api, "jrpc2" if empty.
+	// Version is the version of the api, "0.0.0" if empty.
+	// Description is a description of the api.
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenRPCMethod describes a method of a server.
+type OpenRPCMethod struct {
+	// Name is the name of the method.
+	// Params describes the params of the method, in positional order.
+	// Result describes the result of the method.
+	// ParamStructure is "by-name" if the params can only be passed by name, and
+	// "either" if they can also be passed by position.
+	Name           string                     `json:"name"`
+	Params         []OpenRPCContentDescriptor `json:"params"`
+	Result         OpenRPCContentDescriptor   `json:"result"`
+	ParamStructure string                     `json:"paramStructure,omitempty"`
+}
+
+// OpenRPCContentDescriptor describes a param or result of a method.
+type OpenRPCContentDescriptor struct {
+	Name     string  `json:"name"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+// Discover returns the OpenRPC document of the methods registered with the server.
+// Methods registered with a typed api, such as RegisterFunc, describe the schemas
+// of their params and result, and methods with a params Schema describe their
+// params. The params and result of other methods are not described.
+func (s *Server) Discover(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	info := s.Info
+	if info.Title == "" {
+		info.Title = "jrpc2"
+	}
+	if info.Version == "" {
+		info.Version = "0.0.0"
+	}
+
+	doc := OpenRPCDocument{OpenRPC: OpenRPCVersion, Info: info, Methods: []OpenRPCMethod{}}
+	for _, name := range s.List() {
+		if method, ok := s.Lookup(name); ok {
+			doc.Methods = append(doc.Methods, describeMethod(name, method))
+		}
+	}
+
+	return doc, nil
+}
+
+// describeSchemaParams describes the params of a method from its params schema.
+// The properties of an object schema are described as params passed by name,
+// otherwise the schema describes all the params.
+func describeSchemaParams(m *OpenRPCMethod, schema *Schema) {
+	if schema.Type != "object" || len(schema.Properties) == 0 {
+		m.Params = append(m.Params, OpenRPCContentDescriptor{Name: "params", Schema: schema})
+		return
+	}
+
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.ParamStructure = "by-name"
+	for _, name := range names {
+		m.Params = append(m.Params, OpenRPCContentDescriptor{
+			Name:     name,
+			Required: required[name],
+			Schema:   schema.Properties[name],
+		})
+	}
+}
+
+// describeMethod creates the OpenRPC description of the method.
+func describeMethod(name string, method MethodWithContext) OpenRPCMethod {
+	m := OpenRPCMethod{
+		Name:   name,
+		Params: []OpenRPCContentDescriptor{},
+		Result: OpenRPCContentDescriptor{Name: "result", Schema: &Schema{}},
+	}
+	if method.resultType != nil {
+		m.Result.Schema = schemaOf(method.resultType)
+	}
+	if method.paramsType == nil {
+		if method.Schema != nil {
+			describeSchemaParams(&m, method.Schema)
+		}
+		return m
+	}
+
+	st := structType(method.paramsType)
+	if st == nil {
+		m.Params = append(m.Params, OpenRPCContentDescriptor{Name: "params", Schema: schemaOf(method.paramsType)})
+		return m
+	}
+	fields, err := paramFields(st)
+	if err != nil {
+		return m
+	}
+
+	fields = append([]paramField(nil), fields...)
+	sort.SliceStable(fields, func(i, j int) bool {
+		// named only fields are listed after positional fields
+		return uint(fields[i].Pos) < uint(fields[j].Pos)
+	})
+	m.ParamStructure = "either"
+	for _, f := range fields {
+		if f.Pos < 0 {
+			m.ParamStructure = "by-name"
+		}
+		m.Params = append(m.Params, OpenRPCContentDescriptor{
+			Name:     f.Name,
+			Required: f.Required,
+			Schema:   schemaOf(st.Field(f.Index).Type),
+		})
+	}
+
+	return m
+}
@@ -0,0 +1,94 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type Shape struct {
+	Name   string            `json:"name"`
+	Points []PointParams     `json:"points"`
+	Tags   map[string]string `json:"tags,omitempty"`
+	Parent *Shape            `json:"parent"`
+	Data   []byte            `json:"data"`
+	Seen   time.Time         `json:"seen"`
+	Skip   int               `json:"-"`
+	hidden int
+}
+
+func TestSchemaOf(t *testing.T) {
+	schema, _ := json.Marshal(schemaOf(reflect.TypeOf(Shape{})))
+	expected := `{"type":"object","properties":{` +
+		`"data":{"type":"string","format":"byte"},` +
+		`"name":{"type":"string"},` +
+		`"parent":{},` +
+		`"points":{"type":"array","items":{"type":"object","properties":{"x":{"type":"integer"},"y":{"type":"integer"}}}},` +
+		`"seen":{},` +
+		`"tags":{"type":"object","additionalProperties":{"type":"string"}}}}`
+	if string(schema) != expected {
+		t.Fatalf("Unexpected schema %s", schema)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	s := newTestServer(t, func(ts *testServer) {
+		ts.Info = OpenRPCInfo{Title: "shapes", Version: "1.2.0"}
+		ts.Register("sum", Method{Method: Sum})
+		ts.RegisterFunc("move", func(ctx context.Context, p MoveParams) (*Shape, error) {
+			return nil, nil
+		})
+	})
+
+	var doc OpenRPCDocument
+	if err := s.client.Call(context.Background(), DiscoverMethod, nil, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenRPC != OpenRPCVersion || doc.Info.Title != "shapes" || doc.Info.Version != "1.2.0" {
+		t.Fatalf("Unexpected document %+v", doc)
+	}
+
+	methods := make(map[string]OpenRPCMethod)
+	for _, m := range doc.Methods {
+		methods[m.Name] = m
+	}
+	for _, name := range []string{"jrpc2.register", "jrpc2.unregister", DefaultHealthMethod, "sum", "move"} {
+		if _, ok := methods[name]; !ok {
+			t.Fatalf("Expected method %s in document", name)
+		}
+	}
+	if _, ok := methods[DiscoverMethod]; ok {
+		t.Fatal("Expected rpc.discover to not be listed")
+	}
+
+	move := methods["move"]
+	if move.ParamStructure != "by-name" || len(move.Params) != 4 {
+		t.Fatalf("Unexpected move params %+v", move)
+	}
+	for i, name := range []string{"x", "name", "speed", "note"} {
+		if move.Params[i].Name != name {
+			t.Fatalf("Expected param %d to be %s, got %s", i, name, move.Params[i].Name)
+		}
+	}
+	if !move.Params[0].Required || move.Params[0].Schema.Type != "number" || move.Params[2].Required {
+		t.Fatalf("Unexpected move params %+v", move.Params)
+	}
+	if move.Result.Schema.Type != "object" || move.Result.Schema.Properties["name"].Type != "string" {
+		t.Fatalf("Unexpected move result %+v", move.Result.Schema)
+	}
+
+	if sum := methods["sum"]; len(sum.Params) != 0 || sum.Result.Schema.Type != "" {
+		t.Fatalf("Expected sum to not be described, got %+v", sum)
+	}
+}
+
+func TestDiscoverReservedMethods(t *testing.T) {
+	s := newTestServer(t)
+
+	err := s.client.Call(context.Background(), "rpc.other", nil, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InvalidRequestCode {
+		t.Fatalf("Expected invalid request error for other rpc methods, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Sentinel errors of the predefined error codes. An error object matches a sentinel
+// with errors.Is when their codes are equal, regardless of message and data.
+var (
+	ErrParse              = &ErrorObject{Code: ParseErrorCode, Message: ParseErrorMsg}
+	ErrInvalidRequest     = &ErrorObject{Code: InvalidRequestCode, Message: InvalidRequestMsg}
+	ErrMethodNotFound     = &ErrorObject{Code: MethodNotFoundCode, Message: MethodNotFoundMsg}
+	ErrInvalidParams      = &ErrorObject{Code: InvalidParamsCode, Message: InvalidParamsMsg}
+	ErrInternal           = &ErrorObject{Code: InternalErrorCode, Message: InternalErrorMsg}
+	ErrMethodExists       = &ErrorObject{Code: MethodExistsCode, Message: MethodExistsMsg}
+	ErrURLScheme          = &ErrorObject{Code: URLSchemeErrorCode, Message: URLSchemeErrorMsg}
+	ErrSubscription       = &ErrorObject{Code: SubscriptionErrorCode, Message: SubscriptionErrorMsg}
+	ErrBackendUnavailable = &ErrorObject{Code: BackendUnavailableCode, Message: BackendUnavailableMsg}
+	ErrBackendTimeout     = &ErrorObject{Code: BackendTimeoutCode, Message: BackendTimeoutMsg}
+	ErrBackendError       = &ErrorObject{Code: BackendErrorCode, Message: BackendErrorMsg}
+	ErrCircuitOpen        = &ErrorObject{Code: CircuitOpenCode, Message: CircuitOpenMsg}
+	ErrUnauthorized       = &ErrorObject{Code: UnauthorizedCode, Message: UnauthorizedMsg}
+	ErrForbidden          = &ErrorObject{Code: ForbiddenCode, Message: ForbiddenMsg}
+)
+
+// Is reports whether the target is an error object with the same code. An error
+// object with the RequestCancelledCode also matches ErrRequestCancelled.
+func (e *ErrorObject) Is(target error) bool {
+	if target == ErrRequestCancelled {
+		return e.Code == RequestCancelledCode
+	}
+	t, ok := target.(*ErrorObject)
+
+	return ok && t != nil && t.Code == e.Code
+}
+
+// Unwrap returns the error wrapped by WrapError, if any.
+func (e *ErrorObject) Unwrap() error {
+	return e.err
+}
+
+// WrapError converts an error returned by a method to an error object. An error
+// object found in the error chain is returned as is. Any other error is wrapped in
+// an InternalErrorCode error object with the error message as data, which the
+// server replaces with the error object of a matching error mapping, or redacts
+// if the server RedactErrors option is set.
+func WrapError(err error) *ErrorObject {
+	if err == nil {
+		return nil
+	}
+
+	var errObj *ErrorObject
+	if errors.As(err, &errObj) && errObj != nil {
+		return errObj
+	}
+
+	return &ErrorObject{
+		Code:    InternalErrorCode,
+		Message: InternalErrorMsg,
+		Data:    err.Error(),
+		err:     err,
+	}
+}
+
+// errorMapping maps the errors that match it to an error code and message.
+type errorMapping struct {
+	match   func(err error) bool
+	code    ErrorCode
+	message ErrorMsg
+}
+
+// errorIsMapping creates a mapping of the errors matching the target with errors.Is.
+func errorIsMapping(target error, code ErrorCode, message ErrorMsg) errorMapping {
+	return errorMapping{
+		match:   func(err error) bool { return errors.Is(err, target) },
+		code:    code,
+		message: message,
+	}
+}
+
+// errorTypeMapping creates a mapping of the errors of the same type as the example.
+func errorTypeMapping(example error, code ErrorCode, message ErrorMsg) errorMapping {
+	t := reflect.TypeOf(example)
+	return errorMapping{
+		match:   func(err error) bool { return errors.As(err, reflect.New(t).Interface()) },
+		code:    code,
+		message: message,
+	}
+}
+
+// MapError maps errors matching the target with errors.Is to the error code and
+// message. The error message is used as the error data. Mappings are matched in
+// the order they are added.
+func (s *Server) MapError(target error, code ErrorCode, message ErrorMsg) {
+	s.errorMappings = append(s.errorMappings, errorIsMapping(target, code, message))
+}
+
+// MapErrorType maps errors of the same type as the example, found with errors.As,
+// to the error code and message. The error message is used as the error data.
+func (s *Server) MapErrorType(example error, code ErrorCode, message ErrorMsg) {
+	s.errorMappings = append(s.errorMappings, errorTypeMapping(example, code, message))
+}
+
+// MapError maps errors matching the target with errors.Is to the error code and
+// message for every handler of the mux server.
+func (s *MuxServer) MapError(target error, code ErrorCode, message ErrorMsg) {
+	s.errorMappings = append(s.errorMappings, errorIsMapping(target, code, message))
+}
+
+// MapErrorType maps errors of the same type as the example to the error code and
+// message for every handler of the mux server.
+func (s *MuxServer) MapErrorType(example error, code ErrorCode, message ErrorMsg) {
+	s.errorMappings = append(s.errorMappings, errorTypeMapping(example, code, message))
+}
+
+// resolveError replaces an error wrapped by WrapError with the error object of
+// the first matching error mapping, or redacts its data if there is none and the
+// RedactErrors option is set. Other error objects are returned as is.
+func (s *Server) resolveError(errObj *ErrorObject) *ErrorObject {
+	if errObj == nil || errObj.err == nil {
+		return errObj
+	}
+
+	for _, m := range s.errorMappings {
+		if m.match(errObj.err) {
+			return &ErrorObject{
+				Code:    m.code,
+				Message: m.message,
+				Data:    errObj.err.Error(),
+				err:     errObj.err,
+			}
+		}
+	}
+	if s.RedactErrors {
+		return &ErrorObject{
+			Code:    InternalErrorCode,
+			Message: InternalErrorMsg,
+			err:     errObj.err,
+		}
+	}
+
+	return errObj
+}
@@ -0,0 +1,99 @@
+package jrpc2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var errNotFound = errors.New("record not found")
+
+type quotaError struct {
+	Limit int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota of %d exceeded", e.Limit)
+}
+
+func TestErrorObjectIs(t *testing.T) {
+	errObj := &ErrorObject{Code: MethodNotFoundCode, Message: MethodNotFoundMsg, Data: "sum"}
+	if !errors.Is(errObj, ErrMethodNotFound) || errors.Is(errObj, ErrInvalidParams) {
+		t.Fatal("Expected error object to match sentinel by code")
+	}
+	if !errors.Is(fmt.Errorf("call: %w", errObj), ErrMethodNotFound) {
+		t.Fatal("Expected wrapped error object to match sentinel")
+	}
+	if !errors.Is(cancelledError(cancelledContext()), ErrRequestCancelled) {
+		t.Fatal("Expected cancelled error object to match ErrRequestCancelled")
+	}
+
+	wrapped := WrapError(fmt.Errorf("lookup: %w", errNotFound))
+	if wrapped.Code != InternalErrorCode || wrapped.Data != "lookup: record not found" {
+		t.Fatalf("Unexpected wrapped error %+v", wrapped)
+	}
+	if !errors.Is(wrapped, errNotFound) || !errors.Is(wrapped, ErrInternal) {
+		t.Fatal("Expected wrapped error to match its cause and ErrInternal")
+	}
+	if WrapError(fmt.Errorf("call: %w", errObj)) != errObj {
+		t.Fatal("Expected error object to be unwrapped")
+	}
+	if WrapError(nil) != nil {
+		t.Fatal("Expected nil error to wrap to nil")
+	}
+}
+
+// cancelledContext returns a context cancelled by the client.
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrRequestCancelled)
+	return ctx
+}
+
+func TestErrorMapping(t *testing.T) {
+	s := newTestServer(t, func(ts *testServer) {
+		ts.MapError(errNotFound, -32010, "Not found")
+		ts.MapErrorType(&quotaError{}, -32011, "Quota exceeded")
+		ts.RegisterFunc("find", func(ctx context.Context, p struct{ Kind string }) (string, error) {
+			switch p.Kind {
+			case "missing":
+				return "", fmt.Errorf("find: %w", errNotFound)
+			case "quota":
+				return "", &quotaError{Limit: 10}
+			case "params":
+				return "", ErrInvalidParams
+			}
+			return "", errors.New("database password incorrect")
+		})
+	})
+	c := s.client
+
+	table := []struct {
+		Kind string
+		Code ErrorCode
+		Data interface{}
+	}{
+		{"missing", -32010, "find: record not found"},
+		{"quota", -32011, "quota of 10 exceeded"},
+		{"params", InvalidParamsCode, nil},
+		{"other", InternalErrorCode, "database password incorrect"},
+	}
+	for _, tc := range table {
+		err := c.Call(context.Background(), "find", []string{tc.Kind}, nil)
+		errObj, ok := err.(*ErrorObject)
+		if !ok || errObj.Code != tc.Code || errObj.Data != tc.Data {
+			t.Fatalf("Unexpected error for %s: %v", tc.Kind, err)
+		}
+	}
+
+	s.RedactErrors = true
+	err := c.Call(context.Background(), "find", []string{"other"}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InternalErrorCode || errObj.Data != nil {
+		t.Fatalf("Expected redacted internal error, got %v", err)
+	}
+	err = c.Call(context.Background(), "find", []string{"missing"}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != -32010 {
+		t.Fatalf("Expected mapped error to not be redacted, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Handler is a typed rpc method. The request params are decoded into T and
+// the returned R is encoded as the call result.
+type Handler[T, R any] func(ctx context.Context, params T) (R, error)
+
+// NewFuncMethod wraps fn in a MethodWithContext. The fn argument must be a
+// function of the form func(context.Context, T) (R, error), such as a Handler.
+//
+// Named params are decoded into T. Positional params are assigned to the
+// fields of a struct T as described by ParseParams, otherwise they are
+// decoded into T directly. An error returned by fn is returned to the client
+// as is if it is an *ErrorObject and as an internal error otherwise.
+func NewFuncMethod(fn interface{}) (MethodWithContext, error) {
+	if err := validateFunc(fn); err != nil {
+		return MethodWithContext{}, err
+	}
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	paramsType := ft.In(1)
+	if st := structType(paramsType); st != nil {
+		if _, err := paramFields(st); err != nil {
+			return MethodWithContext{}, err
+		}
+	}
+
+	return MethodWithContext{
+		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+			p, errObj := decodeParams(params, paramsType)
+			if errObj != nil {
+				return nil, errObj
+			}
+
+			out := fv.Call([]reflect.Value{reflect.ValueOf(&ctx).Elem(), p})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return nil, WrapError(err)
+			}
+
+			result, err := json.Marshal(out[0].Interface())
+			if err != nil {
+				return nil, &ErrorObject{
+					Code:    InternalErrorCode,
+					Message: InternalErrorMsg,
+					Data:    err.Error(),
+				}
+			}
+
+			return json.RawMessage(result), nil
+		},
+		paramsType: paramsType,
+		resultType: ft.Out(0),
+	}, nil
+}
+
+// validateFunc checks that fn is a function of the form
+// func(context.Context, T) (R, error).
+func validateFunc(fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("jrpc2: method must be a function, got %T", fn)
+	}
+
+	ft := fv.Type()
+	if ft.IsVariadic() || ft.NumIn() != 2 || ft.NumOut() != 2 {
+		return fmt.Errorf("jrpc2: method must match func(context.Context, T) (R, error), got %s", ft)
+	}
+	if ft.In(0) != contextType {
+		return fmt.Errorf("jrpc2: method first argument must be context.Context, got %s", ft.In(0))
+	}
+	if ft.Out(1) != errorType {
+		return fmt.Errorf("jrpc2: method second return value must be error, got %s", ft.Out(1))
+	}
+
+	return nil
+}
+
+// decodeParams decodes the request params into a new value of type t.
+// Absent or null params produce the zero value of t.
+func decodeParams(params json.RawMessage, t reflect.Type) (reflect.Value, *ErrorObject) {
+	ptr := reflect.New(t)
+	if err := unmarshalParams(params, ptr); err != nil {
+		return reflect.Value{}, paramsError(err)
+	}
+
+	return ptr.Elem(), nil
+}
@@ -0,0 +1,134 @@
+package jrpc2
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type DivideParams struct {
+	Dividend float64 `json:"dividend"`
+	Divisor  float64 `json:"divisor"`
+}
+
+func Divide(ctx context.Context, p DivideParams) (float64, error) {
+	if p.Divisor == 0 {
+		return 0, &ErrorObject{
+			Code:    InvalidParamsCode,
+			Message: InvalidParamsMsg,
+			Data:    "division by zero",
+		}
+	}
+	return p.Dividend / p.Divisor, nil
+}
+
+type GreetParams struct {
+	Name  string `json:"name"`
+	Greet string `json:"greeting"`
+}
+
+func Greet(ctx context.Context, p *GreetParams) (string, error) {
+	if p == nil {
+		return "", errors.New("params are required")
+	}
+	return p.Greet + " " + p.Name, nil
+}
+
+// withFuncs registers the divide and greet funcs.
+func withFuncs(t *testing.T) func(ts *testServer) {
+	return func(ts *testServer) {
+		if err := ts.RegisterFunc("divide", Divide); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.RegisterFunc("greet", Handler[*GreetParams, string](Greet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterFuncCall(t *testing.T) {
+	c := newTestServer(t, withFuncs(t)).client
+
+	table := []struct {
+		Params interface{}
+		Result float64
+	}{
+		{map[string]float64{"dividend": 10, "divisor": 4}, 2.5},
+		{[]float64{9, 3}, 3},
+		{[]float64{9}, 0},
+	}
+	for _, tc := range table {
+		var result float64
+		if tc.Result == 0 {
+			err := c.Call(context.Background(), "divide", tc.Params, &result)
+			var errObj *ErrorObject
+			if !errors.As(err, &errObj) || errObj.Data != "division by zero" {
+				t.Fatalf("Expected division by zero error, got %v", err)
+			}
+			continue
+		}
+		if err := c.Call(context.Background(), "divide", tc.Params, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Result {
+			t.Fatalf("Expected result to be %v, got %v", tc.Result, result)
+		}
+	}
+
+	var greeting string
+	if err := c.Call(context.Background(), "greet", []string{"bob", "Hello"}, &greeting); err != nil {
+		t.Fatal(err)
+	}
+	if greeting != "Hello bob" {
+		t.Fatalf("Unexpected greeting %q", greeting)
+	}
+}
+
+func TestRegisterFuncInvalidParams(t *testing.T) {
+	c := newTestServer(t, withFuncs(t)).client
+
+	table := []interface{}{
+		[]interface{}{1, 2, 3},
+		[]interface{}{"one", 2},
+		map[string]interface{}{"dividend": "one"},
+	}
+	for _, params := range table {
+		err := c.Call(context.Background(), "divide", params, nil)
+		var errObj *ErrorObject
+		if !errors.As(err, &errObj) || errObj.Code != InvalidParamsCode {
+			t.Fatalf("Expected invalid params error for %v, got %v", params, err)
+		}
+	}
+}
+
+func TestRegisterFuncError(t *testing.T) {
+	c := newTestServer(t, withFuncs(t)).client
+
+	err := c.Call(context.Background(), "greet", nil, nil)
+	var errObj *ErrorObject
+	if !errors.As(err, &errObj) || errObj.Code != InternalErrorCode || errObj.Data != "params are required" {
+		t.Fatalf("Expected internal error, got %v", err)
+	}
+}
+
+func TestRegisterFuncSignature(t *testing.T) {
+	table := []interface{}{
+		nil,
+		"divide",
+		func(p DivideParams) (float64, error) { return 0, nil },
+		func(ctx context.Context, p DivideParams) float64 { return 0 },
+		func(ctx context.Context, p DivideParams) (float64, string) { return 0, "" },
+		func(p DivideParams, ctx context.Context) (float64, error) { return 0, nil },
+		func(ctx context.Context, p ...DivideParams) (float64, error) { return 0, nil },
+	}
+
+	s := NewServer("", "/rpc", nil)
+	for _, fn := range table {
+		if err := s.RegisterFunc("invalid", fn); err == nil {
+			t.Fatalf("Expected registration of %T to fail", fn)
+		}
+	}
+	if _, ok := s.Lookup("invalid"); ok {
+		t.Fatal("Expected invalid method to not be registered")
+	}
+}
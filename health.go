@@ -0,0 +1,383 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHealthMethod is the method called to probe the health of a backend
+// server. It is answered by every jrpc2 server.
+const DefaultHealthMethod = "jrpc2.health"
+
+// HealthCheck configures the periodic health probing of the backend servers of
+// proxied methods. A backend is probed by calling the probe method, which must
+// return a result without error.
+type HealthCheck struct {
+	// Method is the method called to probe a backend, DefaultHealthMethod if empty.
+	// Interval is the time between probes, 10 seconds if zero.
+	// Timeout is the time a probe may take, Interval if zero.
+	// FailureThreshold is the number of consecutive failed probes after which a
+	// backend is unhealthy, 1 if zero.
+	// RemoveAfter is the time after which the methods of a backend that stays
+	// unhealthy are unregistered. They are never unregistered if zero.
+	Method           string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	RemoveAfter      time.Duration
+}
+
+// BackendStatus is the health status of the backend server of proxied methods.
+type BackendStatus struct {
+	// Url is the url of the backend.
+	// Healthy reports whether the backend is considered healthy. Calls to the
+	// methods of an unhealthy backend fail with BackendUnavailableCode.
+	// Failures is the number of consecutive failed probes.
+	// LastProbe is the time of the last probe, zero if never probed.
+	// DownSince is the time the backend became unhealthy, zero if healthy.
+	Url       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastProbe time.Time `json:"lastProbe"`
+	DownSince time.Time `json:"downSince"`
+}
+
+// HeartbeatParams is a paramater spec for the Heartbeat method.
+type HeartbeatParams struct {
+	// Url is the url of the backend whose registrations are renewed.
+	Url *string `json:"url" jrpc:"pos=0,required"`
+}
+
+// leaseKey identifies the registration of a backend of a proxied method.
+type leaseKey struct {
+	name string
+	url  string
+}
+
+// lease is the time to live of a proxied method registration.
+type lease struct {
+	ttl     time.Duration
+	expires time.Time
+}
+
+// healthMonitor tracks the health of backends and the leases of proxied methods.
+type healthMonitor struct {
+	mu       sync.Mutex
+	backends map[string]*BackendStatus
+	leases   map[leaseKey]lease
+	start    sync.Once
+	stop     sync.Once
+	done     chan struct{}
+}
+
+// newHealthMonitor creates a health monitor without backends or leases.
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{
+		backends: make(map[string]*BackendStatus),
+		leases:   make(map[leaseKey]lease),
+		done:     make(chan struct{}),
+	}
+}
+
+// healthy reports whether the backend at url is not known to be unhealthy.
+func (h *healthMonitor) healthy(url string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status, ok := h.backends[url]
+	return !ok || status.Healthy
+}
+
+// setLease sets the lease of the method registered with the backend at url.
+func (h *healthMonitor) setLease(name, url string, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.leases[leaseKey{name, url}] = lease{ttl: ttl, expires: time.Now().Add(ttl)}
+}
+
+// leaseTTL returns the ttl of the method registered with the backend at url.
+func (h *healthMonitor) leaseTTL(name, url string) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.leases[leaseKey{name, url}]
+	return l.ttl, ok
+}
+
+// renew extends the leases of the methods registered with the backend at url and
+// returns the number of renewed leases.
+func (h *healthMonitor) renew(url string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for key, l := range h.leases {
+		if key.url == url && now.Before(l.expires) {
+			l.expires = now.Add(l.ttl)
+			h.leases[key] = l
+			n++
+		}
+	}
+
+	return n
+}
+
+// expired reports whether the lease of the method registration with the backend
+// at url has expired.
+func (h *healthMonitor) expired(name, url string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, ok := h.leases[leaseKey{name, url}]
+	return ok && !time.Now().Before(l.expires)
+}
+
+// registryChanged drops the leases of the backends that a method no longer has
+// after it is unregistered or replaced.
+func (h *healthMonitor) registryChanged(event RegistryEvent) {
+	if event.Type == MethodRegistered {
+		return
+	}
+	urls := make(map[string]bool)
+	if event.Type == MethodReplaced {
+		for _, backend := range event.Method.backends() {
+			urls[backend.Url] = true
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.leases {
+		if key.name == event.Name && !urls[key.url] {
+			delete(h.leases, key)
+		}
+	}
+}
+
+// close stops the health checks.
+func (h *healthMonitor) close() {
+	h.stop.Do(func() { close(h.done) })
+}
+
+// Heartbeat accepts a backend url and renews the registrations with a ttl of the
+// methods proxied to the backend. The number of renewed registrations is returned.
+// A backend without a registration to renew must register its methods again.
+// Heartbeats are authorized and audited by the server Registration policy.
+func (s *Server) Heartbeat(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	p := new(HeartbeatParams)
+
+	if err := ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	principal, err := s.authorize(ctx, "jrpc2.heartbeat", params, "", *p.Url)
+	n := 0
+	if err == nil {
+		if n = s.health.renew(*p.Url); n == 0 {
+			err = &ErrorObject{
+				Code:    InvalidParamsCode,
+				Message: InvalidParamsMsg,
+				Data:    "no registrations to renew for url",
+			}
+		}
+	}
+	s.audit(ctx, AuditRecord{Action: "heartbeat", Principal: principal, Url: *p.Url, Error: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Health answers the health probes of proxying servers.
+func (s *Server) Health(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	return "ok", nil
+}
+
+// Backends returns the health status of the backends of the proxied methods,
+// sorted by url.
+func (s *Server) Backends() []BackendStatus {
+	urls := s.backendUrls()
+
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	backends := make([]BackendStatus, 0, len(urls))
+	for url := range urls {
+		status := BackendStatus{Url: url, Healthy: true}
+		if known, ok := s.health.backends[url]; ok {
+			status = *known
+		}
+		backends = append(backends, status)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Url < backends[j].Url })
+
+	return backends
+}
+
+// backendUrls returns the names of the proxied methods by backend url.
+func (s *Server) backendUrls() map[string][]string {
+	urls := make(map[string][]string)
+	for _, name := range s.methods.list() {
+		if method, ok := s.methods.lookup(name); ok {
+			for _, backend := range method.backends() {
+				urls[backend.Url] = append(urls[backend.Url], name)
+			}
+		}
+	}
+
+	return urls
+}
+
+// startHealthChecks starts probing the backends if health checks are configured.
+// The health checks are started once and run until the server is shut down.
+func (s *Server) startHealthChecks() {
+	if s.HealthCheck == nil {
+		return
+	}
+
+	s.health.start.Do(func() {
+		hc := *s.HealthCheck
+		if hc.Method == "" {
+			hc.Method = DefaultHealthMethod
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = 10 * time.Second
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = hc.Interval
+		}
+		if hc.FailureThreshold <= 0 {
+			hc.FailureThreshold = 1
+		}
+
+		go func() {
+			ticker := time.NewTicker(hc.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.health.done:
+					return
+				case <-ticker.C:
+					s.checkHealth(hc)
+				}
+			}
+		}()
+	})
+}
+
+// checkHealth probes every backend once, updates their health status, and
+// unregisters the methods of backends that stayed unhealthy for too long and of
+// expired registrations.
+func (s *Server) checkHealth(hc HealthCheck) {
+	urls := s.backendUrls()
+
+	var wg sync.WaitGroup
+	results := make(map[string]bool, len(urls))
+	var mu sync.Mutex
+	for url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+			defer cancel()
+			err := s.proxyClient(s.proxyConfig(MethodWithContext{}), url).Call(ctx, hc.Method, nil, nil)
+			mu.Lock()
+			results[url] = err == nil
+			mu.Unlock()
+		}(url)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	var remove []string
+	var expired []leaseKey
+	s.health.mu.Lock()
+	for url := range s.health.backends {
+		if _, ok := urls[url]; !ok {
+			delete(s.health.backends, url)
+		}
+	}
+	for url, ok := range results {
+		status, known := s.health.backends[url]
+		if !known {
+			status = &BackendStatus{Url: url, Healthy: true}
+			s.health.backends[url] = status
+		}
+		status.LastProbe = now
+		if ok {
+			status.Healthy, status.Failures, status.DownSince = true, 0, time.Time{}
+			continue
+		}
+		status.Failures++
+		if status.Healthy && status.Failures >= hc.FailureThreshold {
+			status.Healthy, status.DownSince = false, now
+		}
+		if !status.Healthy && hc.RemoveAfter > 0 && now.Sub(status.DownSince) >= hc.RemoveAfter {
+			remove = append(remove, url)
+		}
+	}
+	for key, l := range s.health.leases {
+		if !now.Before(l.expires) {
+			expired = append(expired, key)
+		}
+	}
+	s.health.mu.Unlock()
+
+	for _, url := range remove {
+		for _, name := range urls[url] {
+			s.removeProxied(name, url)
+		}
+	}
+	for _, key := range expired {
+		if s.health.expired(key.name, key.url) {
+			s.removeProxied(key.name, key.url)
+		}
+	}
+}
+
+// removeProxied removes the backend at url from the proxied method, and
+// unregisters the method if it has no other backend. It reports whether the
+// backend was removed.
+func (s *Server) removeProxied(name, url string) bool {
+	return s.methods.update(name, func(m MethodWithContext, exists bool) (MethodWithContext, bool) {
+		backends := m.backends()
+		remaining := make([]Backend, 0, len(backends))
+		for _, backend := range backends {
+			if backend.Url != url {
+				remaining = append(remaining, backend)
+			}
+		}
+		if !exists || len(remaining) == len(backends) {
+			return m, false
+		}
+
+		m.Url, m.Backends = "", remaining
+		return m, true
+	})
+}
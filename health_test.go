@@ -0,0 +1,129 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	backend := newTestServer(t, withSum).srv
+	s := NewServer("", "/rpc", nil)
+	s.Register("sum", Method{Url: backend.URL + "/rpc"})
+	hc := HealthCheck{Method: DefaultHealthMethod, Timeout: time.Second, FailureThreshold: 2, RemoveAfter: time.Hour}
+
+	s.checkHealth(hc)
+	backends := s.Backends()
+	if len(backends) != 1 || !backends[0].Healthy || backends[0].LastProbe.IsZero() {
+		t.Fatalf("Expected healthy backend, got %+v", backends)
+	}
+
+	backend.Close()
+	s.checkHealth(hc)
+	if backends := s.Backends(); !backends[0].Healthy || backends[0].Failures != 1 {
+		t.Fatalf("Expected backend to stay healthy below the failure threshold, got %+v", backends)
+	}
+	s.checkHealth(hc)
+	if backends := s.Backends(); backends[0].Healthy || backends[0].DownSince.IsZero() {
+		t.Fatalf("Expected unhealthy backend, got %+v", backends)
+	}
+
+	_, err := s.Call(context.Background(), "sum", []byte(`[1, 2]`))
+	if err == nil || err.Code != BackendUnavailableCode {
+		t.Fatalf("Expected backend unavailable error, got %v", err)
+	}
+
+	hc.RemoveAfter = time.Nanosecond
+	s.checkHealth(hc)
+	if _, ok := s.Lookup("sum"); ok {
+		t.Fatal("Expected method of dead backend to be unregistered")
+	}
+	if backends := s.Backends(); len(backends) != 0 {
+		t.Fatalf("Expected no backends, got %+v", backends)
+	}
+}
+
+func TestHealthMethod(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	if result, err := s.Call(context.Background(), DefaultHealthMethod, nil); err != nil || result != "ok" {
+		t.Fatalf("Expected ok health response, got %v %v", result, err)
+	}
+	if _, ok := s.Lookup(DefaultHealthMethod); !ok {
+		t.Fatal("Expected health method to be registered")
+	}
+
+	s.Replace(DefaultHealthMethod, MethodWithContext{Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+		return "degraded", nil
+	}})
+	if result, _ := s.Call(context.Background(), DefaultHealthMethod, nil); result != "degraded" {
+		t.Fatalf("Expected replaced health method to be called, got %v", result)
+	}
+}
+
+func TestHealthCheckLoop(t *testing.T) {
+	backend := newTestServer(t, withSum).srv
+	s := newTestServer(t, withProxied(backend.URL+"/rpc", "sum"), func(ts *testServer) {
+		ts.HealthCheck = &HealthCheck{Interval: 10 * time.Millisecond, RemoveAfter: 10 * time.Millisecond}
+	})
+	defer s.health.close()
+
+	var result int
+	if err := s.client.Call(context.Background(), "sum", []int{1, 2}, &result); err != nil || result != 3 {
+		t.Fatalf("Expected proxied result, got %d %v", result, err)
+	}
+
+	backend.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.Lookup("sum"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected method of dead backend to be unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistrationTTL(t *testing.T) {
+	backend := newTestServer(t, withSum).srv
+	s := newTestServer(t)
+	c := s.client
+	url := backend.URL + "/rpc"
+
+	err := c.Call(context.Background(), "jrpc2.register", []interface{}{"sum", url, -1}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InvalidParamsCode {
+		t.Fatalf("Expected invalid ttl error, got %v", err)
+	}
+	if err := c.Call(context.Background(), "jrpc2.register", []interface{}{"sum", url, 0.2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(context.Background(), "jrpc2.register", map[string]interface{}{"name": "subtract", "url": url}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var renewed int
+	if err := c.Call(context.Background(), "jrpc2.heartbeat", []string{url}, &renewed); err != nil || renewed != 1 {
+		t.Fatalf("Expected 1 renewed registration, got %d %v", renewed, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	var result int
+	if err := c.Call(context.Background(), "sum", []int{1, 2}, &result); err != nil || result != 3 {
+		t.Fatalf("Expected renewed registration to be callable, got %d %v", result, err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	err = c.Call(context.Background(), "sum", []int{1, 2}, &result)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != MethodNotFoundCode {
+		t.Fatalf("Expected expired registration to be removed, got %v", err)
+	}
+	if _, ok := s.Lookup("subtract"); !ok {
+		t.Fatal("Expected registration without ttl to remain")
+	}
+	err = c.Call(context.Background(), "jrpc2.heartbeat", []string{url}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InvalidParamsCode {
+		t.Fatalf("Expected heartbeat without registrations to fail, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import "context"
+
+// CallFunc calls the method of a request and returns its result.
+type CallFunc func(ctx context.Context, req *RequestObject) (interface{}, *ErrorObject)
+
+// Interceptor runs around the call of a request method. An interceptor continues
+// the call by calling next, optionally with a different context or request, and
+// may rewrite the returned result or error. An interceptor that returns without
+// calling next short-circuits the call.
+type Interceptor func(ctx context.Context, req *RequestObject, next CallFunc) (interface{}, *ErrorObject)
+
+// chain returns a CallFunc that runs the interceptors around call, the first
+// interceptor being the outermost.
+func chain(interceptors []Interceptor, call CallFunc) CallFunc {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], call
+		call = func(ctx context.Context, req *RequestObject) (interface{}, *ErrorObject) {
+			return interceptor(ctx, req, next)
+		}
+	}
+
+	return call
+}
+
+// Use adds interceptors that run around the call of every method of the server,
+// in the order they are added.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// Use adds interceptors that run around the call of every method of the handler,
+// after the interceptors of the mux server.
+func (h *MuxHandler) Use(interceptors ...Interceptor) {
+	h.interceptors = append(h.interceptors, interceptors...)
+}
+
+// Use adds interceptors that run around the call of every method of every handler
+// of the mux server. Interceptors must be added before the server is prepared.
+func (s *MuxServer) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// intercept calls the request method through the server interceptors and the
+// interceptors of the method.
+func (s *Server) intercept(ctx context.Context, req *RequestObject) (interface{}, *ErrorObject) {
+	return chain(s.interceptors, s.callMethod)(ctx, req)
+}
+
+// callMethod calls the request method through the interceptors registered with
+// the method.
+func (s *Server) callMethod(ctx context.Context, req *RequestObject) (interface{}, *ErrorObject) {
+	call := func(ctx context.Context, req *RequestObject) (interface{}, *ErrorObject) {
+		return s.Call(ctx, req.Method, req.Params)
+	}
+	if name, ok := req.Method.(string); ok {
+		if method, ok := s.methods.lookup(name); ok && len(method.Interceptors) > 0 {
+			call = chain(method.Interceptors, call)
+		}
+	}
+
+	return call(ctx, req)
+}
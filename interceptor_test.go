@@ -0,0 +1,91 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordInterceptor returns an interceptor that appends its name to the calls
+// before continuing the call.
+func recordInterceptor(name string, calls *[]string) Interceptor {
+	return func(ctx context.Context, req *RequestObject, next CallFunc) (interface{}, *ErrorObject) {
+		*calls = append(*calls, name)
+		return next(ctx, req)
+	}
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	var calls []string
+	h := NewMuxHandler()
+	h.Use(recordInterceptor("handler", &calls))
+	h.RegisterWithContext("sum", MethodWithContext{
+		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+			calls = append(calls, "method")
+			return Sum(params)
+		},
+		Interceptors: []Interceptor{recordInterceptor("sum1", &calls), recordInterceptor("sum2", &calls)},
+	})
+	s := NewMuxServer("", nil)
+	s.Use(recordInterceptor("global", &calls))
+	s.AddHandler("/rpc", h)
+	srv := httptest.NewServer(s.Prepare().Handler)
+	defer srv.Close()
+
+	var result int
+	if err := NewClient(srv.URL+"/rpc", nil).Call(context.Background(), "sum", []int{1, 2}, &result); err != nil || result != 3 {
+		t.Fatalf("Expected result 3, got %d %v", result, err)
+	}
+
+	expected := []string{"global", "handler", "sum1", "sum2", "method"}
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("Expected calls %v, got %v", expected, calls)
+		}
+	}
+}
+
+func TestInterceptorShortCircuitAndRewrite(t *testing.T) {
+	c := newTestServer(t, func(ts *testServer) {
+		ts.Register("sum", Method{Method: Sum})
+		ts.Use(func(ctx context.Context, req *RequestObject, next CallFunc) (interface{}, *ErrorObject) {
+			if req.Method == "forbidden" {
+				return nil, &ErrorObject{Code: -32000, Message: ServerErrorMsg, Data: "forbidden"}
+			}
+			if req.Method == "add" {
+				req.Method = "sum"
+			}
+			result, err := next(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"value": result}, nil
+		})
+	}).client
+
+	var result map[string]int
+	if err := c.Call(context.Background(), "add", []int{2, 3}, &result); err != nil || result["value"] != 5 {
+		t.Fatalf("Expected rewritten result, got %v %v", result, err)
+	}
+	err := c.Call(context.Background(), "forbidden", nil, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Data != "forbidden" {
+		t.Fatalf("Expected short-circuit error, got %v", err)
+	}
+
+	b := c.NewBatch()
+	first := b.Call("add", []int{1, 1}, &result)
+	second := b.Call("forbidden", nil, nil)
+	if err := b.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if first.Err() != nil || result["value"] != 2 {
+		t.Fatalf("Expected rewritten batch result, got %v %v", result, first.Err())
+	}
+	if errObj, ok := second.Err().(*ErrorObject); !ok || errObj.Data != "forbidden" {
+		t.Fatalf("Expected short-circuit batch error, got %v", second.Err())
+	}
+}
@@ -0,0 +1,78 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withPanic registers the panic method, which panics when its first param isn't a
+// string.
+func withPanic(ts *testServer) {
+	ts.RegisterWithContext("panic", MethodWithContext{
+		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+			var p []interface{}
+			json.Unmarshal(params, &p)
+			return p[0].(string), nil
+		},
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var mu sync.Mutex
+	var panics []interface{}
+	c := newTestServer(t, withSum, withPanic, func(ts *testServer) {
+		ts.PanicHandler = func(ctx context.Context, req *RequestObject, v interface{}, stack []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			if req.Method != "panic" || len(stack) == 0 {
+				t.Errorf("Unexpected panic report for %v", req.Method)
+			}
+			panics = append(panics, v)
+		}
+	}).client
+
+	err := c.Call(context.Background(), "panic", []int{1}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InternalErrorCode || errObj.Data != nil {
+		t.Fatalf("Expected internal error without data, got %v", err)
+	}
+
+	var sum int
+	b := c.NewBatch()
+	first := b.Call("panic", []int{1}, nil)
+	second := b.Call("sum", []int{1, 2}, &sum)
+	if err := b.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if errObj, ok := first.Err().(*ErrorObject); !ok || errObj.Code != InternalErrorCode {
+		t.Fatalf("Expected internal error in batch, got %v", first.Err())
+	}
+	if second.Err() != nil || sum != 3 {
+		t.Fatalf("Expected batch sum result, got %d %v", sum, second.Err())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(panics) != 2 {
+		t.Fatalf("Expected 2 reported panics, got %d", len(panics))
+	}
+}
+
+func TestPanicRecoveryDebug(t *testing.T) {
+	c := newTestServer(t, withSum, withPanic, func(ts *testServer) {
+		ts.Debug = true
+		ts.PanicHandler = func(ctx context.Context, req *RequestObject, v interface{}, stack []byte) {}
+	}).client
+
+	err := c.Call(context.Background(), "panic", []int{1}, nil)
+	errObj, ok := err.(*ErrorObject)
+	if !ok || errObj.Code != InternalErrorCode {
+		t.Fatalf("Expected internal error, got %v", err)
+	}
+	data, _ := errObj.Data.(string)
+	if !strings.HasPrefix(data, "panic: interface conversion") || !strings.Contains(data, "goroutine") {
+		t.Fatalf("Expected panic stack trace in data, got %q", data)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// paramField describes a struct field that can be set by a request param.
+type paramField struct {
+	// Index is the index of the field in the struct.
+	// Name is the json name of the field.
+	// Pos is the position of the field in positional params, or -1 if the
+	// field can only be set by name.
+	// Required indicates that the param must be provided and not null.
+	Index    int
+	Name     string
+	Pos      int
+	Required bool
+}
+
+// paramTagError reports an invalid jrpc struct tag.
+type paramTagError struct {
+	Type  reflect.Type
+	Field string
+	Msg   string
+}
+
+func (e *paramTagError) Error() string {
+	return fmt.Sprintf("jrpc2: invalid jrpc tag on %s.%s: %s", e.Type, e.Field, e.Msg)
+}
+
+// paramFieldsCache caches the param fields of struct types.
+var paramFieldsCache sync.Map
+
+// paramFields returns the fields of the struct type t that can be set by
+// request params.
+//
+// The position and requirement of a field are set with the jrpc struct tag,
+// e.g. `jrpc:"pos=0,required"`. If no field has a pos option, every exported
+// field is positional in declaration order. Fields ignored by encoding/json
+// are skipped.
+func paramFields(t reflect.Type) ([]paramField, error) {
+	if fields, ok := paramFieldsCache.Load(t); ok {
+		return fields.([]paramField), nil
+	}
+
+	fields := make([]paramField, 0, t.NumField())
+	tagged := false
+	seen := make(map[int]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+
+		field := paramField{Index: i, Name: name, Pos: -1}
+		if tag, ok := f.Tag.Lookup("jrpc"); ok && tag != "" {
+			for _, opt := range strings.Split(tag, ",") {
+				switch {
+				case opt == "required":
+					field.Required = true
+				case strings.HasPrefix(opt, "pos="):
+					pos, err := strconv.Atoi(strings.TrimPrefix(opt, "pos="))
+					if err != nil || pos < 0 {
+						return nil, &paramTagError{t, f.Name, fmt.Sprintf("invalid position %q", opt)}
+					}
+					if other, ok := seen[pos]; ok {
+						return nil, &paramTagError{t, f.Name, fmt.Sprintf("position %d already used by %s", pos, other)}
+					}
+					seen[pos] = f.Name
+					field.Pos = pos
+					tagged = true
+				default:
+					return nil, &paramTagError{t, f.Name, fmt.Sprintf("unknown option %q", opt)}
+				}
+			}
+		}
+		fields = append(fields, field)
+	}
+
+	if !tagged {
+		for i := range fields {
+			fields[i].Pos = i
+		}
+	}
+
+	paramFieldsCache.Store(t, fields)
+
+	return fields, nil
+}
+
+// hasParamTags reports whether the struct type t, or the struct type t
+// points to, declares any jrpc struct tags.
+func hasParamTags(t reflect.Type) bool {
+	st := structType(t)
+	if st == nil {
+		return false
+	}
+	for i := 0; i < st.NumField(); i++ {
+		if _, ok := st.Field(i).Tag.Lookup("jrpc"); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// structType returns the struct type of t, or of the type t points to.
+// A nil type is returned if t is not a struct type.
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return t
+}
+
+// unmarshalParams decodes the request params into the value ptr points to.
+//
+// Named params are decoded by encoding/json. Positional params are assigned
+// to the param fields of a struct, otherwise they are decoded directly.
+// Absent or null params leave the value unchanged. Required params of a
+// struct are checked in every case.
+func unmarshalParams(params json.RawMessage, ptr reflect.Value) error {
+	v := ptr.Elem()
+	st := structType(v.Type())
+	var fields []paramField
+	if st != nil {
+		var err error
+		if fields, err = paramFields(st); err != nil {
+			return err
+		}
+	}
+
+	raw := bytes.TrimSpace(params)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return checkNamedRequired(nil, fields)
+	}
+
+	if st != nil && raw[0] == '[' {
+		var posParams []json.RawMessage
+		if err := json.Unmarshal(raw, &posParams); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(st))
+			}
+			v = v.Elem()
+		}
+		return decodePositional(posParams, v, fields)
+	}
+
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return describeParamError(err, "", -1)
+	}
+	if st != nil && raw[0] == '{' {
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &named); err != nil {
+			return err
+		}
+		return checkNamedRequired(named, fields)
+	}
+
+	return nil
+}
+
+// decodePositional decodes the positional params into the param fields of
+// the struct value v.
+func decodePositional(params []json.RawMessage, v reflect.Value, fields []paramField) error {
+	byPos := make(map[int]paramField, len(fields))
+	maxPos := -1
+	for _, f := range fields {
+		if f.Pos >= 0 {
+			byPos[f.Pos] = f
+			if f.Pos > maxPos {
+				maxPos = f.Pos
+			}
+		}
+	}
+
+	if len(params) > maxPos+1 {
+		return fmt.Errorf("too many params: expected at most %d, got %d", maxPos+1, len(params))
+	}
+
+	for i, param := range params {
+		f, ok := byPos[i]
+		if !ok {
+			return fmt.Errorf("unexpected param at position %d", i)
+		}
+		field := v.Field(f.Index)
+		if err := json.Unmarshal(param, field.Addr().Interface()); err != nil {
+			return describeParamError(err, f.Name, i)
+		}
+	}
+
+	for _, f := range fields {
+		if !f.Required {
+			continue
+		}
+		if f.Pos < 0 {
+			return fmt.Errorf("missing required param %q", f.Name)
+		}
+		if f.Pos >= len(params) || isNull(params[f.Pos]) {
+			return fmt.Errorf("missing required param %q (position %d)", f.Name, f.Pos)
+		}
+	}
+
+	return nil
+}
+
+// checkNamedRequired checks that every required field is present and not
+// null in the named params.
+func checkNamedRequired(named map[string]json.RawMessage, fields []paramField) error {
+	for _, f := range fields {
+		if !f.Required {
+			continue
+		}
+		found := false
+		for key, value := range named {
+			if strings.EqualFold(key, f.Name) && !isNull(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("missing required param %q", f.Name)
+		}
+	}
+
+	return nil
+}
+
+// describeParamError rewrites json type errors to name the offending param.
+// A pos of -1 indicates a named param.
+func describeParamError(err error, name string, pos int) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		if name != "" {
+			return fmt.Errorf("param %q (position %d): %v", name, pos, err)
+		}
+		return err
+	}
+
+	if pos >= 0 {
+		if typeErr.Field != "" {
+			name = name + "." + typeErr.Field
+		}
+		return fmt.Errorf("param %q (position %d): expected %s, got %s", name, pos, typeErr.Type, typeErr.Value)
+	}
+	if typeErr.Field != "" {
+		return fmt.Errorf("param %q: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+
+	return fmt.Errorf("params: expected %s, got %s", typeErr.Type, typeErr.Value)
+}
+
+// isNull reports whether the raw json value is null.
+func isNull(raw json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
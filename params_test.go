@@ -0,0 +1,121 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+type MoveParams struct {
+	Name  string   `json:"name" jrpc:"pos=1,required"`
+	X     *float64 `json:"x" jrpc:"pos=0,required"`
+	Speed float64  `json:"speed" jrpc:"pos=2"`
+	Note  string   `json:"note"`
+}
+
+type PointParams struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type BadTagParams struct {
+	X int `jrpc:"pos=0"`
+	Y int `jrpc:"pos=0"`
+}
+
+func TestParseParamsTags(t *testing.T) {
+	table := []struct {
+		Params string
+		Name   string
+		X      float64
+		Speed  float64
+	}{
+		{`[1.5, "box"]`, "box", 1.5, 0},
+		{`[2, "box", 3]`, "box", 2, 3},
+		{`{"name": "box", "x": 4, "speed": 5}`, "box", 4, 5},
+	}
+
+	for _, tc := range table {
+		p := new(MoveParams)
+		if err := ParseParams(json.RawMessage(tc.Params), p); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", tc.Params, err)
+		}
+		if p.Name != tc.Name || p.X == nil || *p.X != tc.X || p.Speed != tc.Speed {
+			t.Fatalf("Unexpected params for %s: %+v", tc.Params, p)
+		}
+	}
+}
+
+func TestParseParamsTagErrors(t *testing.T) {
+	table := []struct {
+		Params string
+		Data   string
+	}{
+		{`[1.5]`, `missing required param "name" (position 1)`},
+		{`[null, "box"]`, `missing required param "x" (position 0)`},
+		{`[1.5, 2]`, `param "name" (position 1): expected string, got number`},
+		{`["one", "box"]`, `param "x" (position 0): expected float64, got string`},
+		{`[1, "box", 3, 4]`, `too many params: expected at most 3, got 4`},
+		{`{"x": 1}`, `missing required param "name"`},
+		{`{"x": 1, "name": null}`, `missing required param "name"`},
+		{`{"x": "one", "name": "box"}`, `param "x": expected float64, got string`},
+		{``, `missing required param "name"`},
+	}
+
+	for _, tc := range table {
+		err := ParseParams(json.RawMessage(tc.Params), new(MoveParams))
+		if err == nil {
+			t.Fatalf("Expected error for %s", tc.Params)
+		}
+		if err.Code != InvalidParamsCode {
+			t.Fatalf("Expected invalid params code for %s, got %d", tc.Params, err.Code)
+		}
+		if err.Data != tc.Data {
+			t.Fatalf("Expected data %q for %s, got %q", tc.Data, tc.Params, err.Data)
+		}
+	}
+}
+
+func TestParseParamsDeclarationOrder(t *testing.T) {
+	p := new(PointParams)
+	if err := ParseParams(json.RawMessage(`[3, 4]`), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.X != 3 || p.Y != 4 {
+		t.Fatalf("Unexpected params %+v", p)
+	}
+
+	if err := ParseParams(json.RawMessage(`[3, 4, 5]`), new(PointParams)); err == nil {
+		t.Fatal("Expected too many params error")
+	}
+}
+
+func TestParseParamsInvalidTarget(t *testing.T) {
+	if err := ParseParams(json.RawMessage(`[1, 2]`), new(BadTagParams)); err == nil || err.Code != InternalErrorCode {
+		t.Fatalf("Expected internal error for invalid tags, got %v", err)
+	}
+	if err := ParseParams(json.RawMessage(`[1, 2]`), PointParams{}); err == nil || err.Code != InternalErrorCode {
+		t.Fatalf("Expected internal error for non-pointer params, got %v", err)
+	}
+	if err := NewServer("", "/rpc", nil).RegisterFunc("bad", func(ctx context.Context, p BadTagParams) (int, error) {
+		return 0, nil
+	}); err == nil {
+		t.Fatal("Expected registration with invalid tags to fail")
+	}
+}
+
+func TestRegisterRPCInvalidParams(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+
+	table := []string{
+		`["subtract"]`,
+		`[1, "http://localhost:31501/api/v2/rpc"]`,
+		`{"name": "subtract"}`,
+	}
+	for _, params := range table {
+		_, err := s.RegisterRPC(context.Background(), json.RawMessage(params))
+		if err == nil || err.Code != InvalidParamsCode {
+			t.Fatalf("Expected invalid params error for %s, got %v", params, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrPeerClosed is returned when sending to a peer whose connection is closed.
+var ErrPeerClosed = errors.New("jrpc2: peer connection closed")
+
+// peerKey is the context key of the peer of a persistent connection.
+type peerKey struct{}
+
+// Peer is the client end of a persistent connection, such as a websocket or
+// stream connection. Methods called over a persistent connection can obtain the
+// peer from their context to send notifications or make calls to the client.
+type Peer struct {
+	conn     messageConn
+	writeMu  sync.Mutex
+	id       uint64
+	mu       sync.Mutex
+	pending  map[string]chan *clientResponse
+	done     chan struct{}
+	inflight inflight
+}
+
+// newPeer creates the peer of the connection.
+func newPeer(conn messageConn) *Peer {
+	return &Peer{
+		conn:    conn,
+		pending: make(map[string]chan *clientResponse),
+		done:    make(chan struct{}),
+	}
+}
+
+// PeerFromContext returns the peer of the connection the request was received
+// on. The ok result is false for requests that were not received over a
+// persistent connection, such as http requests.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+	return peer, ok
+}
+
+// Notify sends a notification of the named method with the provided params to
+// the client.
+func (p *Peer) Notify(ctx context.Context, method string, params interface{}) error {
+	body, err := newRequest(method, params, nil)
+	if err != nil {
+		return err
+	}
+
+	return p.send(body)
+}
+
+// Call invokes the named method on the client with the provided params and
+// decodes the call result into result. It waits for the client's response until
+// ctx is done or the connection is closed. Errors returned by the client are
+// returned as *ErrorObject.
+func (p *Peer) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := atomic.AddUint64(&p.id, 1)
+	body, err := newRequest(method, params, id)
+	if err != nil {
+		return err
+	}
+
+	key, _ := json.Marshal(id)
+	ch := make(chan *clientResponse, 1)
+	p.mu.Lock()
+	p.pending[string(key)] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, string(key))
+		p.mu.Unlock()
+	}()
+
+	if err := p.send(body); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp.decode(id, result)
+	case <-p.done:
+		return ErrPeerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when the connection is closed.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// send writes a request message to the peer connection unless it is closed.
+func (p *Peer) send(data []byte) error {
+	select {
+	case <-p.done:
+		return ErrPeerClosed
+	default:
+	}
+
+	return p.write(data)
+}
+
+// write writes a message to the peer connection.
+func (p *Peer) write(data []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.conn.WriteMessage(data)
+}
+
+// close marks the connection closed and fails pending calls. Responses to in
+// flight requests can still be written.
+func (p *Peer) close() {
+	close(p.done)
+}
+
+// handleResponse delivers a response, or a batch of responses, to the pending
+// calls with matching ids. It reports whether data contained responses rather
+// than requests.
+func (p *Peer) handleResponse(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return false
+	}
+
+	var resps []json.RawMessage
+	if data[0] == '[' {
+		if err := json.Unmarshal(data, &resps); err != nil || len(resps) == 0 {
+			return false
+		}
+	} else {
+		resps = []json.RawMessage{data}
+	}
+
+	decoded := make([]*clientResponse, 0, len(resps))
+	for _, raw := range resps {
+		var probe struct {
+			Method json.RawMessage `json:"method"`
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil || probe.Method != nil {
+			return false
+		}
+		if probe.Result == nil && probe.Error == nil {
+			return false
+		}
+		resp := new(clientResponse)
+		if err := json.Unmarshal(raw, resp); err != nil {
+			return false
+		}
+		decoded = append(decoded, resp)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, resp := range decoded {
+		if ch, ok := p.pending[string(bytes.TrimSpace(resp.Id))]; ok {
+			ch <- resp
+			delete(p.pending, string(bytes.TrimSpace(resp.Id)))
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,148 @@
+package jrpc2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// withConfirm registers the confirm method, which notifies the peer of its progress
+// twice and answers with the answer of the peer to the ask method. The error of
+// the call to the peer is sent to errs if it isn't nil.
+func withConfirm(errs chan error) func(ts *testServer) {
+	return func(ts *testServer) {
+		ts.RegisterWithContext("confirm", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				peer, ok := PeerFromContext(ctx)
+				if !ok {
+					return nil, &ErrorObject{Code: InternalErrorCode, Message: InternalErrorMsg, Data: "no peer"}
+				}
+				for i := 1; i <= 2; i++ {
+					if err := peer.Notify(ctx, "progress", []int{i}); err != nil {
+						return nil, WrapError(err)
+					}
+				}
+
+				var answer string
+				err := peer.Call(ctx, "ask", []string{"continue?"}, &answer)
+				if errs != nil {
+					errs <- err
+				}
+				if err != nil {
+					return nil, WrapError(err)
+				}
+				return answer, nil
+			},
+		})
+	}
+}
+
+// testDeadline returns the read deadline of test connections.
+func testDeadline() time.Time {
+	return time.Now().Add(5 * time.Second)
+}
+
+// readMessage reads a single newline delimited message from the reader.
+func readMessage(t *testing.T, conn net.Conn, rdr *bufio.Reader) map[string]interface{} {
+	conn.SetReadDeadline(testDeadline())
+	line, err := rdr.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		t.Fatalf("Error decoding message %s: %v", line, err)
+	}
+
+	return msg
+}
+
+func TestPeerNotifyAndCall(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newTestServer(t, withConfirm(nil)).ServeConn(conn)
+
+	rdr := bufio.NewReader(client)
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "confirm", "id": "c1"}` + "\n"))
+
+	for i := 1; i <= 2; i++ {
+		msg := readMessage(t, client, rdr)
+		if msg["method"] != "progress" || msg["id"] != nil {
+			t.Fatalf("Expected progress notification, got %v", msg)
+		}
+		if params := msg["params"].([]interface{}); params[0] != float64(i) {
+			t.Fatalf("Unexpected progress params %v", params)
+		}
+	}
+
+	call := readMessage(t, client, rdr)
+	if call["method"] != "ask" || call["id"] == nil {
+		t.Fatalf("Expected ask call, got %v", call)
+	}
+	reply, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "result": "yes", "id": call["id"]})
+	go client.Write(append(reply, '\n'))
+
+	resp := readMessage(t, client, rdr)
+	if resp["id"] != "c1" || resp["result"] != "yes" {
+		t.Fatalf("Unexpected response %v", resp)
+	}
+}
+
+func TestPeerCallError(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go newTestServer(t, withConfirm(nil)).ServeConn(conn)
+
+	rdr := bufio.NewReader(client)
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "confirm", "id": 1}` + "\n"))
+	readMessage(t, client, rdr)
+	readMessage(t, client, rdr)
+	call := readMessage(t, client, rdr)
+
+	reply, _ := json.Marshal([]interface{}{map[string]interface{}{
+		"jsonrpc": "2.0",
+		"error":   map[string]interface{}{"code": -32001, "message": "Server error", "data": "refused"},
+		"id":      call["id"],
+	}})
+	go client.Write(append(reply, '\n'))
+
+	resp := readMessage(t, client, rdr)
+	errObj, ok := resp["error"].(map[string]interface{})
+	if !ok || errObj["code"] != -32001.0 || errObj["data"] != "refused" {
+		t.Fatalf("Expected peer error to be returned, got %v", resp)
+	}
+}
+
+func TestPeerClosed(t *testing.T) {
+	errs := make(chan error, 1)
+	client, conn := net.Pipe()
+	go newTestServer(t, withConfirm(errs)).ServeConn(conn)
+
+	rdr := bufio.NewReader(client)
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "confirm", "id": 1}` + "\n"))
+	for i := 0; i < 3; i++ {
+		readMessage(t, client, rdr)
+	}
+	client.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrPeerClosed {
+			t.Fatalf("Expected peer closed error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected pending peer call to fail")
+	}
+}
+
+func TestPeerFromHTTPContext(t *testing.T) {
+	c := newTestServer(t, withConfirm(nil)).client
+
+	err := c.Call(context.Background(), "confirm", nil, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Data != "no peer" {
+		t.Fatalf("Expected no peer error, got %v", err)
+	}
+}
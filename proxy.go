@@ -0,0 +1,292 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ProxyConfig configures the outbound calls of proxied methods to their backends.
+// The calls of a configuration share a pool of connections, so a configuration
+// must not be modified once in use. It is replaced instead, which closes the idle
+// connections of the replaced configuration.
+type ProxyConfig struct {
+	// Timeout limits each attempt of a proxied call. Attempts are only limited by
+	// the context of the call if zero.
+	// DialTimeout limits connecting to a backend, 30 seconds if zero.
+	// MaxIdleConnsPerHost is the number of idle connections kept open to each
+	// backend, 2 if zero.
+	// IdleConnTimeout is the time an idle connection is kept open, 90 seconds if
+	// zero.
+	// Retries is the number of times a call is retried after every backend failed
+	// with a retryable error.
+	// RetryBackoff is the delay before the first retry, which doubles for each
+	// following retry, 100 milliseconds if zero.
+	// MaxRetryBackoff limits the delay between retries, unlimited if zero.
+	// Idempotent reports whether a method can be called again after a request that
+	// may have reached a backend failed. Other methods are only retried or failed
+	// over when the request could not be sent. No method is idempotent if nil.
+	// Headers contains the http headers sent with each proxied request.
+	// ForwardBatches forwards the calls of a batch request proxied to the same
+	// backend as a single upstream batch. Each call waits until every other call
+	// of the batch is either waiting to be forwarded or has completed.
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	Retries             int
+	RetryBackoff        time.Duration
+	MaxRetryBackoff     time.Duration
+	Idempotent          func(method string) bool
+	Headers             map[string]string
+	ForwardBatches      bool
+}
+
+// defaultProxyConfig is the proxy configuration of servers without one.
+var defaultProxyConfig = &ProxyConfig{}
+
+// proxyClientKey identifies the client of a backend for a proxy configuration.
+type proxyClientKey struct {
+	config *ProxyConfig
+	url    string
+}
+
+// proxyConfig returns the proxy configuration of the method.
+func (s *Server) proxyConfig(method MethodWithContext) *ProxyConfig {
+	if method.Proxy != nil {
+		return method.Proxy
+	}
+	if s.Proxy != nil {
+		return s.Proxy
+	}
+
+	return defaultProxyConfig
+}
+
+// proxyClient returns the client used to proxy calls to the server at url. The
+// clients of a proxy configuration share a pooling http client.
+func (s *Server) proxyClient(config *ProxyConfig, url string) *Client {
+	key := proxyClientKey{config, url}
+	if c, ok := s.proxyClients.Load(key); ok {
+		return c.(*Client)
+	}
+
+	httpClient, ok := s.proxyHTTPClients.Load(config)
+	if !ok {
+		httpClient, _ = s.proxyHTTPClients.LoadOrStore(config, newProxyHTTPClient(config))
+	}
+	client := NewClient(url, config.Headers)
+	client.HTTPClient = httpClient.(*http.Client)
+	c, _ := s.proxyClients.LoadOrStore(key, client)
+
+	return c.(*Client)
+}
+
+// proxyChanged releases the clients of the proxy configurations no longer used
+// after a method is replaced or unregistered. The event of a replaced method holds
+// the new method, so the configuration of the old one is unknown.
+func (s *Server) proxyChanged(event RegistryEvent) {
+	if event.Type != MethodRegistered {
+		s.releaseProxyClients()
+	}
+}
+
+// releaseProxyClients removes the clients of the proxy configurations no longer
+// used by the server or its methods, and closes their idle connections.
+func (s *Server) releaseProxyClients() {
+	used := map[*ProxyConfig]bool{s.proxyConfig(MethodWithContext{}): true}
+	for _, name := range s.methods.list() {
+		if method, ok := s.methods.lookup(name); ok && method.Proxy != nil {
+			used[method.Proxy] = true
+		}
+	}
+
+	s.proxyClients.Range(func(key, value interface{}) bool {
+		if !used[key.(proxyClientKey).config] {
+			s.proxyClients.Delete(key)
+		}
+		return true
+	})
+	s.proxyHTTPClients.Range(func(key, value interface{}) bool {
+		if !used[key.(*ProxyConfig)] {
+			s.proxyHTTPClients.Delete(key)
+			value.(*http.Client).CloseIdleConnections()
+		}
+		return true
+	})
+}
+
+// newProxyHTTPClient creates the pooling http client of a proxy configuration.
+func newProxyHTTPClient(config *ProxyConfig) *http.Client {
+	dialTimeout := config.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 30 * time.Second
+	}
+	idleConnTimeout := config.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+
+	return &http.Client{Transport: transport}
+}
+
+// forward calls the method on the backends in order until a call succeeds. A
+// call fails over to the next backend, and is retried with backoff once every
+// backend failed, if its error is retryable.
+func (s *Server) forward(ctx context.Context, config *ProxyConfig, name string, order []Backend, params json.RawMessage) (interface{}, *ErrorObject) {
+	idempotent := config.Idempotent != nil && config.Idempotent(name)
+	backoff := config.RetryBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	var err error
+	retries := 0
+	for attempt := 0; ; attempt++ {
+		var result interface{}
+		if result, err = s.attempt(ctx, config, order[attempt%len(order)].Url, name, params); err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil || !retryable(err, idempotent) {
+			break
+		}
+		if (attempt+1)%len(order) != 0 {
+			continue
+		}
+		if retries >= config.Retries {
+			break
+		}
+
+		retries++
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, s.proxyError(ctx, ctx.Err())
+		case <-timer.C:
+		}
+		if backoff *= 2; config.MaxRetryBackoff > 0 && backoff > config.MaxRetryBackoff {
+			backoff = config.MaxRetryBackoff
+		}
+	}
+
+	return nil, s.proxyError(ctx, err)
+}
+
+// attempt makes a single call of the method to the backend at url, if its circuit
+// lets the call through.
+func (s *Server) attempt(ctx context.Context, config *ProxyConfig, url, name string, params json.RawMessage) (interface{}, error) {
+	record, err := s.guardCall(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+	done := s.trackBackendCall(url)
+	defer done()
+
+	var result interface{}
+	err = s.proxyCall(ctx, config, url, name, params, &result)
+	record(err)
+
+	return result, err
+}
+
+// retryable reports whether a failed proxied call can be made again. A call that
+// failed before its request was sent or was rejected by an open circuit can always
+// be made again, and calls of idempotent methods can be made again after a network
+// error or a bad gateway, service unavailable or gateway timeout response.
+func retryable(err error, idempotent bool) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var transportErr *TransportError
+	if !errors.As(err, &transportErr) {
+		return false
+	}
+	if notSent(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+
+	switch transportErr.StatusCode {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// notSent reports whether the error occurred before the request could be sent,
+// while resolving or connecting to the backend.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr)
+}
+
+// proxyError maps the error of a failed proxied call to the error object returned
+// to the client. Error objects returned by the backend are returned as is.
+func (s *Server) proxyError(ctx context.Context, err error) *ErrorObject {
+	var errObj *ErrorObject
+	if errors.As(err, &errObj) && errObj != ErrCircuitOpen {
+		return errObj
+	}
+
+	var netErr net.Error
+	var transportErr *TransportError
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		errObj = &ErrorObject{Code: RequestCancelledCode, Message: RequestCancelledMsg}
+	case errors.Is(err, ErrCircuitOpen):
+		errObj = &ErrorObject{Code: CircuitOpenCode, Message: CircuitOpenMsg}
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		errObj = &ErrorObject{Code: BackendTimeoutCode, Message: BackendTimeoutMsg}
+	case errors.As(err, &transportErr) && transportErr.StatusCode == 0:
+		errObj = &ErrorObject{Code: BackendUnavailableCode, Message: BackendUnavailableMsg}
+	default:
+		errObj = &ErrorObject{Code: BackendErrorCode, Message: BackendErrorMsg}
+	}
+	if !s.RedactErrors {
+		errObj.Data = err.Error()
+	}
+
+	return errObj
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// batchForwarderKey is the context key of the forwarder of the batch a request
+// belongs to.
+type batchForwarderKey struct{}
+
+// batchForwarder groups the proxied calls of the requests of a batch by backend,
+// so that the calls to a backend are forwarded as a single upstream batch. Calls
+// wait in their group until every other running request of the batch either
+// waits in a group or has completed, and all groups are then sent.
+type batchForwarder struct {
+	s      *Server
+	mu     sync.Mutex
+	active int
+	groups map[proxyClientKey][]*forwardCall
+}
+
+// forwardCall is a proxied call waiting to be forwarded in an upstream batch.
+type forwardCall struct {
+	name      string
+	params    json.RawMessage
+	result    interface{}
+	err       error
+	done      chan struct{}
+	delivered bool
+	abandoned bool
+	group     *forwardGroup
+}
+
+// forwardGroup is an upstream batch being sent. The batch is cancelled once every
+// call of the group has been abandoned.
+type forwardGroup struct {
+	remaining int
+	cancel    context.CancelFunc
+}
+
+// newBatchForwarder creates a forwarder for a batch, held active by its caller
+// until all requests of the batch are dispatched.
+func (s *Server) newBatchForwarder() *batchForwarder {
+	return &batchForwarder{
+		s:      s,
+		active: 1,
+		groups: make(map[proxyClientKey][]*forwardCall),
+	}
+}
+
+// context returns the context of a request of the batch.
+func (f *batchForwarder) context(ctx context.Context) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return context.WithValue(ctx, batchForwarderKey{}, f)
+}
+
+// begin marks a request of the batch as running.
+func (f *batchForwarder) begin() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active++
+}
+
+// end marks a request of the batch as completed, sending the waiting groups if it
+// was the last running request.
+func (f *batchForwarder) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active--
+	f.flush()
+}
+
+// flush sends the waiting groups once no request of the batch is running. It must
+// be called with the lock held.
+func (f *batchForwarder) flush() {
+	if f.active > 0 || len(f.groups) == 0 {
+		return
+	}
+
+	for key, calls := range f.groups {
+		ctx, cancel := context.WithCancel(context.Background())
+		group := &forwardGroup{remaining: len(calls), cancel: cancel}
+		for _, call := range calls {
+			call.group = group
+		}
+		go f.send(ctx, key, calls)
+	}
+	f.groups = make(map[proxyClientKey][]*forwardCall)
+}
+
+// send forwards the calls of a group to their backend and delivers the results.
+func (f *batchForwarder) send(ctx context.Context, key proxyClientKey, calls []*forwardCall) {
+	defer calls[0].group.cancel()
+	if key.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, key.config.Timeout)
+		defer cancel()
+	}
+
+	client := f.s.proxyClient(key.config, key.url)
+	if len(calls) == 1 {
+		calls[0].err = client.Call(ctx, calls[0].name, calls[0].params, &calls[0].result)
+	} else {
+		batch := client.NewBatch()
+		pending := make([]*BatchCall, len(calls))
+		for i, call := range calls {
+			pending[i] = batch.Call(call.name, call.params, &call.result)
+		}
+		batch.Send(ctx)
+		for i, call := range calls {
+			call.err = pending[i].Err()
+		}
+	}
+
+	f.mu.Lock()
+	for _, call := range calls {
+		if !call.abandoned {
+			call.delivered = true
+			f.active++
+		}
+	}
+	f.mu.Unlock()
+	for _, call := range calls {
+		close(call.done)
+	}
+}
+
+// call queues the proxied call in the group of the backend and waits for its
+// result. A call whose context is done before the result is delivered is
+// abandoned, and the upstream batch is cancelled if all its calls are abandoned.
+func (f *batchForwarder) call(ctx context.Context, config *ProxyConfig, url, name string, params json.RawMessage, result *interface{}) error {
+	call := &forwardCall{name: name, params: params, done: make(chan struct{})}
+	key := proxyClientKey{config, url}
+
+	f.mu.Lock()
+	f.groups[key] = append(f.groups[key], call)
+	f.active--
+	f.flush()
+	f.mu.Unlock()
+
+	select {
+	case <-call.done:
+		*result = call.result
+		return call.err
+	case <-ctx.Done():
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if call.delivered {
+		return ctx.Err()
+	}
+	call.abandoned = true
+	f.active++
+	if call.group == nil {
+		f.remove(key, call)
+		return ctx.Err()
+	}
+	if call.group.remaining--; call.group.remaining == 0 {
+		call.group.cancel()
+	}
+
+	return ctx.Err()
+}
+
+// remove removes an abandoned call from the waiting group of the backend. It must
+// be called with the lock held.
+func (f *batchForwarder) remove(key proxyClientKey, call *forwardCall) {
+	calls := f.groups[key]
+	for i, c := range calls {
+		if c == call {
+			calls = append(calls[:i:i], calls[i+1:]...)
+			break
+		}
+	}
+	if len(calls) == 0 {
+		delete(f.groups, key)
+	} else {
+		f.groups[key] = calls
+	}
+}
+
+// proxyCall calls the method on the backend at url, through the forwarder of the
+// batch the call belongs to if the proxy configuration forwards batches.
+func (s *Server) proxyCall(ctx context.Context, config *ProxyConfig, url, name string, params json.RawMessage, result *interface{}) error {
+	if f, ok := ctx.Value(batchForwarderKey{}).(*batchForwarder); ok && config.ForwardBatches {
+		return f.call(ctx, config, url, name, params, result)
+	}
+
+	return s.proxyClient(config, url).Call(ctx, name, params, result)
+}
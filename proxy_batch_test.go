@@ -0,0 +1,128 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sendForwardBatch sends a batch calling whoami and fail twice and sum once, and
+// checks the results.
+func sendForwardBatch(t *testing.T, c *Client, whoami string) {
+	batch := c.NewBatch()
+	names := make([]string, 2)
+	calls := []*BatchCall{
+		batch.Call("whoami", nil, &names[0]),
+		batch.Call("fail", nil, nil),
+		batch.Call("sum", []int{1, 2}, nil),
+		batch.Call("whoami", nil, &names[1]),
+		batch.Call("fail", nil, nil),
+	}
+	batch.Notify("whoami", nil)
+	if err := batch.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{0, 2, 3} {
+		if err := calls[i].Err(); err != nil {
+			t.Fatalf("Unexpected error for call %d: %v", i, err)
+		}
+	}
+	for _, i := range []int{1, 4} {
+		if errObj, ok := calls[i].Err().(*ErrorObject); !ok || errObj.Code != -32050 {
+			t.Fatalf("Expected backend error object for call %d, got %v", i, calls[i].Err())
+		}
+	}
+	if names[0] != whoami || names[1] != whoami {
+		t.Fatalf("Expected whoami results %s, got %v", whoami, names)
+	}
+}
+
+func TestForwardBatches(t *testing.T) {
+	var posts int64
+	a := newBalanceTestBackend(t, "a", countRequests(&posts))
+	c := newTestServer(t, withSum, withProxy(&ProxyConfig{ForwardBatches: true}), withProxied(a.URL+"/rpc", "whoami", "fail")).client
+
+	sendForwardBatch(t, c, "a")
+	if n := atomic.LoadInt64(&posts); n != 1 {
+		t.Fatalf("Expected calls to be forwarded in 1 upstream batch, got %d requests", n)
+	}
+}
+
+func TestForwardBatchesByBackend(t *testing.T) {
+	var postsA, postsB int64
+	a, b := newBalanceTestBackend(t, "a", countRequests(&postsA)), newBalanceTestBackend(t, "b", countRequests(&postsB))
+	c := newTestServer(t, withProxy(&ProxyConfig{ForwardBatches: true}), withProxied(a.URL+"/rpc", "whoami"), withProxied(b.URL+"/rpc", "fail")).client
+
+	batch := c.NewBatch()
+	var name string
+	whoami := batch.Call("whoami", nil, &name)
+	fail := batch.Call("fail", nil, nil)
+	if err := batch.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if whoami.Err() != nil || name != "a" {
+		t.Fatalf("Expected whoami result from backend a, got %q, %v", name, whoami.Err())
+	}
+	if errObj, ok := fail.Err().(*ErrorObject); !ok || errObj.Data != "b" {
+		t.Fatalf("Expected fail error from backend b, got %v", fail.Err())
+	}
+	if na, nb := atomic.LoadInt64(&postsA), atomic.LoadInt64(&postsB); na != 1 || nb != 1 {
+		t.Fatalf("Expected 1 request to each backend, got %d and %d", na, nb)
+	}
+}
+
+func TestForwardBatchesParallelism(t *testing.T) {
+	var posts int64
+	a := newBalanceTestBackend(t, "a", countRequests(&posts))
+	c := newTestServer(t, withSum, withProxy(&ProxyConfig{ForwardBatches: true}), withProxied(a.URL+"/rpc", "whoami", "fail"), func(ts *testServer) {
+		ts.MaxBatchParallelism = 2
+	}).client
+
+	sendForwardBatch(t, c, "a")
+	if n := atomic.LoadInt64(&posts); n < 1 || n > 5 {
+		t.Fatalf("Unexpected number of backend requests %d", n)
+	}
+}
+
+func TestForwardBatchesDisabled(t *testing.T) {
+	var posts int64
+	a := newBalanceTestBackend(t, "a", countRequests(&posts))
+	c := newTestServer(t, withSum, withProxied(a.URL+"/rpc", "whoami", "fail")).client
+
+	sendForwardBatch(t, c, "a")
+	if n := atomic.LoadInt64(&posts); n != 5 {
+		t.Fatalf("Expected 1 request per call, got %d", n)
+	}
+}
+
+func TestForwardBatchesTimeout(t *testing.T) {
+	var posts int64
+	a := newBalanceTestBackend(t, "a", countRequests(&posts))
+	s := newTestServer(t, withProxy(&ProxyConfig{ForwardBatches: true, Timeout: 50 * time.Millisecond}), withProxied(a.URL+"/rpc", "whoami"))
+	s.RegisterWithContext("slow", MethodWithContext{
+		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+			time.Sleep(200 * time.Millisecond)
+			return "done", nil
+		},
+	})
+
+	batch := s.client.NewBatch()
+	whoami := batch.Call("whoami", nil, nil)
+	slow := batch.Call("slow", nil, nil)
+	if err := batch.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(whoami.Err(), ErrBackendTimeout) {
+		t.Fatalf("Expected call waiting to be forwarded to time out, got %v", whoami.Err())
+	}
+	if slow.Err() != nil {
+		t.Fatal(slow.Err())
+	}
+	if n := atomic.LoadInt64(&posts); n != 0 {
+		t.Fatalf("Expected abandoned call not to be forwarded, got %d requests", n)
+	}
+}
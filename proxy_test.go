@@ -0,0 +1,239 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newProxyTestBackend creates a backend that answers every call with the result
+// returned by fn, or with the http status if fn returns one other than 200.
+func newProxyTestBackend(t *testing.T, fn func(r *http.Request) (int, interface{})) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		status, result := fn(r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": req.Id})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// withProxy sets the proxy configuration of the test server.
+func withProxy(config *ProxyConfig) func(ts *testServer) {
+	return func(ts *testServer) { ts.Proxy = config }
+}
+
+func TestProxyTimeout(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		return http.StatusOK, nil
+	})
+	c := newTestServer(t, withProxy(&ProxyConfig{Timeout: 50 * time.Millisecond}), withProxied(backend.URL, "slow")).client
+
+	err := c.Call(context.Background(), "slow", nil, nil)
+	if !errors.Is(err, ErrBackendTimeout) {
+		t.Fatalf("Expected backend timeout error, got %v", err)
+	}
+}
+
+func TestProxyRetries(t *testing.T) {
+	var calls int64
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		if atomic.AddInt64(&calls, 1)%3 != 0 {
+			return http.StatusServiceUnavailable, nil
+		}
+		return http.StatusOK, "done"
+	})
+	c := newTestServer(t, withProxy(&ProxyConfig{
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Idempotent:   func(method string) bool { return method == "get" },
+	}), withProxied(backend.URL, "get", "put")).client
+
+	var result string
+	if err := c.Call(context.Background(), "get", nil, &result); err != nil || result != "done" {
+		t.Fatalf("Expected idempotent call to be retried, got %q, %v", result, err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 3 {
+		t.Fatalf("Expected 3 backend calls, got %d", n)
+	}
+
+	err := c.Call(context.Background(), "put", nil, nil)
+	if !errors.Is(err, ErrBackendError) {
+		t.Fatalf("Expected backend error, got %v", err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 4 {
+		t.Fatalf("Expected call not to be retried, got %d backend calls", n)
+	}
+}
+
+func TestProxyRetriesExhausted(t *testing.T) {
+	var calls int64
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		atomic.AddInt64(&calls, 1)
+		return http.StatusBadGateway, nil
+	})
+	c := newTestServer(t, withProxy(&ProxyConfig{
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Idempotent:   func(method string) bool { return true },
+	}), withProxied(backend.URL, "get")).client
+
+	err := c.Call(context.Background(), "get", nil, nil)
+	if !errors.Is(err, ErrBackendError) {
+		t.Fatalf("Expected backend error, got %v", err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 3 {
+		t.Fatalf("Expected 3 backend calls, got %d", n)
+	}
+}
+
+func TestProxyCancel(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+		return http.StatusOK, nil
+	})
+	c := newTestServer(t, withProxied(backend.URL, "wait")).client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	c.Call(ctx, "wait", nil, nil)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected backend call to be cancelled with the client call")
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, r.Header.Get("X-Api-Key")
+	})
+	c := newTestServer(t, withProxy(&ProxyConfig{Headers: map[string]string{"X-Api-Key": "server"}}), withProxied(backend.URL, "key")).client
+
+	var key string
+	if err := c.Call(context.Background(), "key", nil, &key); err != nil || key != "server" {
+		t.Fatalf("Expected server proxy headers, got %q, %v", key, err)
+	}
+}
+
+func TestProxyHandleRequest(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, "pong"
+	})
+	s := newTestServer(t, withProxied(backend.URL, "ping"))
+
+	w := httptest.NewRecorder()
+	s.HandleRequest(w, &RequestObject{Jsonrpc: "2.0", Method: "ping", Id: 1})
+	if body := strings.TrimSpace(w.Body.String()); body != `{"jsonrpc":"2.0","result":"pong","id":1}` {
+		t.Fatalf("Expected proxied response to a request without a context, got %s", body)
+	}
+}
+
+func TestProxyMethodConfig(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, r.Header.Get("X-Api-Key")
+	})
+	s := newTestServer(t, withProxy(&ProxyConfig{Headers: map[string]string{"X-Api-Key": "server"}}))
+	s.RegisterWithContext("key", MethodWithContext{
+		Url:   backend.URL,
+		Proxy: &ProxyConfig{Headers: map[string]string{"X-Api-Key": "method"}},
+	})
+
+	var key string
+	if err := s.client.Call(context.Background(), "key", nil, &key); err != nil || key != "method" {
+		t.Fatalf("Expected method proxy headers, got %q, %v", key, err)
+	}
+}
+
+func TestProxyConfigReleased(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, r.Header.Get("X-Api-Key")
+	})
+	s := NewServer("", "/rpc", nil)
+	s.Proxy = &ProxyConfig{Headers: map[string]string{"X-Api-Key": "server"}}
+	s.RegisterWithContext("key", MethodWithContext{Url: backend.URL})
+	s.RegisterWithContext("method", MethodWithContext{
+		Url:   backend.URL,
+		Proxy: &ProxyConfig{Headers: map[string]string{"X-Api-Key": "method"}},
+	})
+	clients := func() []*ProxyConfig {
+		var configs []*ProxyConfig
+		s.proxyHTTPClients.Range(func(key, value interface{}) bool {
+			configs = append(configs, key.(*ProxyConfig))
+			return true
+		})
+		return configs
+	}
+
+	s.Call(context.Background(), "key", nil)
+	s.Call(context.Background(), "method", nil)
+	if configs := clients(); len(configs) != 2 {
+		t.Fatalf("Expected a client for each config, got %d configs", len(configs))
+	}
+
+	s.Replace("method", MethodWithContext{Url: backend.URL})
+	if configs := clients(); len(configs) != 1 || configs[0] != s.Proxy {
+		t.Fatalf("Expected clients of the replaced method to be released, got %v", configs)
+	}
+
+	s.Call(context.Background(), "method", nil)
+	s.Replace("method", MethodWithContext{
+		Url:   backend.URL,
+		Proxy: &ProxyConfig{Headers: map[string]string{"X-Api-Key": "method"}},
+	})
+	s.Call(context.Background(), "method", nil)
+	s.Unregister("method")
+	if configs := clients(); len(configs) != 1 || configs[0] != s.Proxy {
+		t.Fatalf("Expected clients of the unregistered method to be released, got %v", configs)
+	}
+}
+
+func TestMuxServerProxy(t *testing.T) {
+	backend := newProxyTestBackend(t, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, r.Header.Get("X-Api-Key")
+	})
+	h := NewMuxHandler()
+	h.RegisterWithContext("key", MethodWithContext{Url: backend.URL})
+	s := NewMuxServer("", nil)
+	s.Proxy = &ProxyConfig{Headers: map[string]string{"X-Api-Key": "mux"}}
+	s.CircuitBreaker = &CircuitBreaker{}
+	s.AddHandler("/rpc", h)
+	srv := httptest.NewServer(s.Prepare().Handler)
+	defer srv.Close()
+
+	var key string
+	if err := NewClient(srv.URL+"/rpc", nil).Call(context.Background(), "key", nil, &key); err != nil || key != "mux" {
+		t.Fatalf("Expected mux server proxy headers, got %q, %v", key, err)
+	}
+	if _, ok := s.servers[0].circuits.circuits[backend.URL]; !ok {
+		t.Fatal("Expected the call to pass through the mux server circuit breaker")
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"sort"
+	"sync"
+)
+
+// RegistryEventType identifies the kind of change made to a method registry.
+type RegistryEventType int
+
+const (
+	// MethodRegistered indicates a method was registered under a new name.
+	MethodRegistered RegistryEventType = iota
+	// MethodReplaced indicates a registered method was replaced.
+	MethodReplaced
+	// MethodUnregistered indicates a method was unregistered.
+	MethodUnregistered
+)
+
+// RegistryEvent describes a change made to a method registry.
+type RegistryEvent struct {
+	// Type is the kind of change.
+	// Name is the name of the changed method.
+	// Method is the registered method, or the removed method for MethodUnregistered
+	// events.
+	Type   RegistryEventType
+	Name   string
+	Method MethodWithContext
+}
+
+// registry is a method registry that is safe for concurrent use.
+type registry struct {
+	mu      sync.RWMutex
+	methods map[string]MethodWithContext
+	hooks   []func(RegistryEvent)
+}
+
+// newRegistry creates an empty method registry.
+func newRegistry() *registry {
+	return &registry{methods: make(map[string]MethodWithContext)}
+}
+
+// set registers the method under name, replacing any existing method.
+func (r *registry) set(name string, method MethodWithContext) {
+	r.mu.Lock()
+	_, exists := r.methods[name]
+	r.methods[name] = method
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	event := RegistryEvent{Type: MethodRegistered, Name: name, Method: method}
+	if exists {
+		event.Type = MethodReplaced
+	}
+	notify(hooks, event)
+}
+
+// add registers the method under name if no method is registered under it and
+// reports whether the method was added.
+func (r *registry) add(name string, method MethodWithContext) bool {
+	r.mu.Lock()
+	if _, exists := r.methods[name]; exists {
+		r.mu.Unlock()
+		return false
+	}
+	r.methods[name] = method
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	notify(hooks, RegistryEvent{Type: MethodRegistered, Name: name, Method: method})
+
+	return true
+}
+
+// replace replaces the method registered under name and reports whether a
+// method was registered under it.
+func (r *registry) replace(name string, method MethodWithContext) bool {
+	r.mu.Lock()
+	if _, exists := r.methods[name]; !exists {
+		r.mu.Unlock()
+		return false
+	}
+	r.methods[name] = method
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	notify(hooks, RegistryEvent{Type: MethodReplaced, Name: name, Method: method})
+
+	return true
+}
+
+// update atomically updates the method registered under name and reports whether
+// the registry changed. fn is called with the registered method, if any, and
+// returns the method to register, or false to leave the registry unchanged. The
+// method is unregistered if fn returns a method without a Method, Url or Backends.
+func (r *registry) update(name string, fn func(method MethodWithContext, exists bool) (MethodWithContext, bool)) bool {
+	r.mu.Lock()
+	old, exists := r.methods[name]
+	method, ok := fn(old, exists)
+	if !ok {
+		r.mu.Unlock()
+		return false
+	}
+
+	event := RegistryEvent{Type: MethodRegistered, Name: name, Method: method}
+	if method.Method == nil && method.Url == "" && len(method.Backends) == 0 {
+		if !exists {
+			r.mu.Unlock()
+			return false
+		}
+		delete(r.methods, name)
+		event = RegistryEvent{Type: MethodUnregistered, Name: name, Method: old}
+	} else {
+		r.methods[name] = method
+		if exists {
+			event.Type = MethodReplaced
+		}
+	}
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	notify(hooks, event)
+
+	return true
+}
+
+// remove unregisters the method registered under name if match reports true
+// for it, and reports whether the method was removed. A nil match removes any
+// method.
+func (r *registry) remove(name string, match func(MethodWithContext) bool) bool {
+	r.mu.Lock()
+	method, exists := r.methods[name]
+	if !exists || (match != nil && !match(method)) {
+		r.mu.Unlock()
+		return false
+	}
+	delete(r.methods, name)
+	hooks := r.hooks
+	r.mu.Unlock()
+
+	notify(hooks, RegistryEvent{Type: MethodUnregistered, Name: name, Method: method})
+
+	return true
+}
+
+// importMethods registers each of the methods, replacing any existing method of
+// the same name.
+func (r *registry) importMethods(methods map[string]MethodWithContext) {
+	for name, method := range methods {
+		r.set(name, method)
+	}
+}
+
+// lookup returns the method registered under name.
+func (r *registry) lookup(name string) (MethodWithContext, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	method, ok := r.methods[name]
+	return method, ok
+}
+
+// list returns the sorted names of the registered methods.
+func (r *registry) list() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.methods))
+	for name := range r.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// onChange adds a hook called after every change made to the registry.
+func (r *registry) onChange(hook func(RegistryEvent)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hooks := make([]func(RegistryEvent), len(r.hooks), len(r.hooks)+1)
+	copy(hooks, r.hooks)
+	r.hooks = append(hooks, hook)
+}
+
+// notify calls each hook with the event.
+func notify(hooks []func(RegistryEvent), event RegistryEvent) {
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
@@ -0,0 +1,159 @@
+package jrpc2
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	s := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := NewClient(s.url, nil)
+			name := fmt.Sprintf("proxy%d", i)
+			if err := c.Call(context.Background(), "jrpc2.register", []string{name, "http://localhost:31501/rpc"}, nil); err != nil {
+				t.Error(err)
+			}
+			s.Lookup(name)
+			s.List()
+			if err := c.Call(context.Background(), "jrpc2.unregister", []string{name}, nil); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, ok := s.Lookup("proxy0"); ok {
+		t.Fatal("Expected proxy0 to be unregistered")
+	}
+}
+
+func TestRegistryHooks(t *testing.T) {
+	h := NewMuxHandler()
+	var events []RegistryEvent
+	h.OnRegistryChange(func(e RegistryEvent) { events = append(events, e) })
+
+	h.Register("sum", Method{Method: Sum})
+	h.Register("sum", Method{Method: Sum})
+	if !h.Replace("sum", MethodWithContext{Url: "http://localhost:31501/rpc"}) {
+		t.Fatal("Expected sum to be replaced")
+	}
+	if h.Replace("subtract", MethodWithContext{Url: "http://localhost:31501/rpc"}) {
+		t.Fatal("Expected replace of unregistered method to fail")
+	}
+	if m, ok := h.Lookup("sum"); !ok || m.Url != "http://localhost:31501/rpc" {
+		t.Fatalf("Unexpected method %+v", m)
+	}
+	if !h.Unregister("sum") || h.Unregister("sum") {
+		t.Fatal("Expected sum to be unregistered once")
+	}
+
+	expected := []RegistryEventType{MethodRegistered, MethodReplaced, MethodReplaced, MethodUnregistered}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		if e.Type != expected[i] || e.Name != "sum" {
+			t.Fatalf("Unexpected event %d: %+v", i, e)
+		}
+	}
+	if len(h.List()) != 0 {
+		t.Fatalf("Expected no methods, got %v", h.List())
+	}
+}
+
+func TestUnregisterRPC(t *testing.T) {
+	s := newTestServer(t, func(ts *testServer) {
+		ts.Register("sum", Method{Method: Sum})
+		ts.Register("add", Method{Url: "http://localhost:31501/rpc"})
+	})
+	c := s.client
+
+	table := []struct {
+		Params []string
+		Code   ErrorCode
+	}{
+		{[]string{"sum"}, InvalidParamsCode},
+		{[]string{"missing"}, MethodNotFoundCode},
+		{[]string{"add", "http://localhost:31502/rpc"}, InvalidParamsCode},
+	}
+	for _, tc := range table {
+		err := c.Call(context.Background(), "jrpc2.unregister", tc.Params, nil)
+		if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != tc.Code {
+			t.Fatalf("Expected code %d for %v, got %v", tc.Code, tc.Params, err)
+		}
+	}
+
+	var result string
+	if err := c.Call(context.Background(), "jrpc2.unregister", []string{"add", "http://localhost:31501/rpc"}, &result); err != nil || result != "success" {
+		t.Fatalf("Expected unregister to succeed, got %q %v", result, err)
+	}
+	if _, ok := s.Lookup("add"); ok {
+		t.Fatal("Expected add to be unregistered")
+	}
+	if _, ok := s.Lookup("sum"); !ok {
+		t.Fatal("Expected sum to remain registered")
+	}
+}
+
+func TestDeprecatedMethods(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	s.Methods["legacy"] = withContext(Method{Method: Sum})
+	s.Prepare()
+	if _, ok := s.Lookup("legacy"); !ok {
+		t.Fatal("Expected server Methods to be registered when the server is prepared")
+	}
+
+	h := NewMuxHandler()
+	h.Methods["legacy"] = withContext(Method{Method: Sum})
+	mux := NewMuxServer("", nil)
+	mux.AddHandler("/rpc", h)
+	mux.Prepare()
+	if _, ok := h.Lookup("legacy"); !ok {
+		t.Fatal("Expected handler Methods to be registered when the mux server is prepared")
+	}
+}
+
+func TestDeprecatedMethodsWithoutPrepare(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	s.Methods["legacy"] = withContext(Method{Method: Sum})
+	if result, err := s.Call(context.Background(), "legacy", []byte(`[1, 2]`)); err != nil || result != 3.0 {
+		t.Fatalf("Expected server Methods to be called without preparing the server, got %v, %v", result, err)
+	}
+
+	s = NewServer("", "/rpc", nil)
+	s.Methods["legacy"] = withContext(Method{Method: Sum})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc": "2.0", "method": "legacy", "params": [1, 2], "id": 1}`))
+	if err := s.ParseRequest(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(w.Body.String()) != `{"jsonrpc":"2.0","result":3,"id":1}` {
+		t.Fatalf("Expected server Methods to be handled without preparing the server, got %s", w.Body)
+	}
+}
+
+func TestMuxHandlerLiteral(t *testing.T) {
+	h := &MuxHandler{Methods: map[string]MethodWithContext{"legacy": withContext(Method{Method: Sum})}}
+	h.Register("sum", Method{Method: Sum})
+	mux := NewMuxServer("", nil)
+	mux.AddHandler("/rpc", h)
+	srv := httptest.NewServer(mux.Prepare().Handler)
+	defer srv.Close()
+
+	c := NewClient(srv.URL+"/rpc", nil)
+	for _, name := range []string{"sum", "legacy"} {
+		var result float64
+		if err := c.Call(context.Background(), name, []int{1, 2}, &result); err != nil || result != 3 {
+			t.Fatalf("Expected %s to be called on a handler literal, got %v, %v", name, result, err)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Schema is a JSON Schema describing a json value. It supports a subset of the
+// keywords of JSON Schema draft 2020-12, and other keywords are ignored when a
+// schema is decoded from json.
+type Schema struct {
+	// Type is the json type of the value, one of "null", "boolean", "integer",
+	// "number", "string", "array" or "object". Any type is allowed if empty.
+	// Format is a hint on the format of a string value. It is not validated.
+	// Enum contains the allowed values.
+	// Minimum and Maximum are the inclusive limits of a number.
+	// ExclusiveMinimum and ExclusiveMaximum are the exclusive limits of a number.
+	// MinLength and MaxLength are the limits of the length of a string.
+	// Pattern is a regular expression matched by a string.
+	// Properties contains the schemas of the properties of an object.
+	// Required contains the names of the required properties of an object.
+	// AdditionalProperties is the schema of object properties not listed in
+	// Properties.
+	// PrefixItems contains the schemas of the leading items of an array.
+	// Items is the schema of the items of an array not covered by PrefixItems.
+	// MinItems and MaxItems are the limits of the length of an array.
+	// AnyOf contains schemas of which the value must match at least one.
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	PrefixItems          []*Schema          `json:"prefixItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+}
+
+// SchemaViolation describes a value that doesn't match its schema.
+type SchemaViolation struct {
+	// InstanceLocation is the JSON Pointer to the value within the params.
+	// Keyword is the schema keyword that the value violates.
+	// Message describes the violation.
+	InstanceLocation string `json:"instanceLocation"`
+	Keyword          string `json:"keyword"`
+	Message          string `json:"error"`
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOf derives the schema of the json encoding of values of type t.
+// Types with custom json encodings and interface types produce an empty schema,
+// which matches any value.
+func schemaOf(t reflect.Type) *Schema {
+	return deriveSchema(t, make(map[reflect.Type]bool))
+}
+
+// deriveSchema derives the schema of type t. Types being derived are tracked in
+// seen so that recursive types terminate with an empty schema.
+func deriveSchema(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) {
+		return &Schema{}
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: deriveSchema(t.Elem(), seen)}
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return &Schema{Type: "object"}
+		}
+		return &Schema{Type: "object", AdditionalProperties: deriveSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return &Schema{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addStructProperties(s, t, seen)
+		return s
+	}
+
+	return &Schema{}
+}
+
+// addStructProperties adds the json encoded fields of the struct type t to the
+// properties of the schema. Fields of embedded structs without a json name are
+// promoted as they are by encoding/json.
+func addStructProperties(s *Schema, t reflect.Type, seen map[reflect.Type]bool) {
+	var fields map[int]paramField
+	if pf, err := paramFields(t); err == nil {
+		fields = make(map[int]paramField, len(pf))
+		for _, f := range pf {
+			fields[f.Index] = f
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := jsonFieldName(f)
+		if !ok {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructProperties(s, ft, seen)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s.Properties[name] = deriveSchema(f.Type, seen)
+		if fields[i].Required {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// jsonFieldName returns the json name of the struct field, which is empty if the
+// field has no json tag name, and reports whether the field is encoded.
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	tag, ok := f.Tag.Lookup("json")
+	if !ok {
+		return "", true
+	}
+	name := strings.Split(tag, ",")[0]
+
+	return name, name != "-"
+}
+
+// Validate validates the json encoded value against the schema and returns the
+// violations found. Absent params are validated as null.
+func (s *Schema) Validate(data json.RawMessage) []SchemaViolation {
+	var v interface{}
+	if raw := bytes.TrimSpace(data); len(raw) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return []SchemaViolation{{Keyword: "type", Message: err.Error()}}
+		}
+	}
+
+	var violations []SchemaViolation
+	s.validate(v, "", &violations)
+
+	return violations
+}
+
+// Check returns an error if the schema or one of its subschemas has an invalid
+// pattern, in which case the schema can't validate values.
+func (s *Schema) Check() error {
+	if s.Pattern != "" {
+		if _, err := compilePattern(s.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+	}
+
+	subschemas := append(append([]*Schema{s.AdditionalProperties, s.Items}, s.PrefixItems...), s.AnyOf...)
+	for _, property := range s.Properties {
+		subschemas = append(subschemas, property)
+	}
+	for _, subschema := range subschemas {
+		if subschema == nil {
+			continue
+		}
+		if err := subschema.Check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate appends the violations of the decoded value at the location to
+// violations.
+func (s *Schema) validate(v interface{}, location string, violations *[]SchemaViolation) {
+	violate := func(keyword, format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{
+			InstanceLocation: location,
+			Keyword:          keyword,
+			Message:          fmt.Sprintf(format, args...),
+		})
+	}
+
+	if s.Type != "" && !hasType(v, s.Type) {
+		violate("type", "expected %s, got %s", s.Type, jsonType(v))
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		violate("enum", "value is not one of the allowed values")
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			var subViolations []SchemaViolation
+			if sub.validate(v, location, &subViolations); len(subViolations) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violate("anyOf", "value does not match any of the schemas")
+		}
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		n, _ := strconv.ParseFloat(string(v), 64)
+		if s.Minimum != nil && n < *s.Minimum {
+			violate("minimum", "%v is less than %v", v, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			violate("maximum", "%v is greater than %v", v, *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && n <= *s.ExclusiveMinimum {
+			violate("exclusiveMinimum", "%v is not greater than %v", v, *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && n >= *s.ExclusiveMaximum {
+			violate("exclusiveMaximum", "%v is not less than %v", v, *s.ExclusiveMaximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			violate("minLength", "length %d is less than %d", length, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			violate("maxLength", "length %d is greater than %d", length, *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			if re, err := compilePattern(s.Pattern); err != nil {
+				violate("pattern", "invalid pattern %q", s.Pattern)
+			} else if !re.MatchString(v) {
+				violate("pattern", "value does not match pattern %q", s.Pattern)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			violate("minItems", "%d items is less than %d", len(v), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			violate("maxItems", "%d items is greater than %d", len(v), *s.MaxItems)
+		}
+		for i, item := range v {
+			itemLocation := location + "/" + strconv.Itoa(i)
+			if i < len(s.PrefixItems) {
+				s.PrefixItems[i].validate(item, itemLocation, violations)
+			} else if s.Items != nil {
+				s.Items.validate(item, itemLocation, violations)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violate("required", "missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propLocation := location + "/" + escapePointer(name)
+			if prop, ok := s.Properties[name]; ok {
+				prop.validate(v[name], propLocation, violations)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(v[name], propLocation, violations)
+			}
+		}
+	}
+}
+
+// jsonType returns the json type of a decoded value.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if isInteger(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+
+	return "object"
+}
+
+// hasType reports whether the decoded value is of the json type. Integers are
+// also numbers.
+func hasType(v interface{}, t string) bool {
+	actual := jsonType(v)
+
+	return actual == t || (t == "number" && actual == "integer")
+}
+
+// isInteger reports whether the number has no fractional part.
+func isInteger(n json.Number) bool {
+	if _, err := n.Int64(); err == nil {
+		return true
+	}
+	f, err := n.Float64()
+
+	return err == nil && f == math.Trunc(f)
+}
+
+// inEnum reports whether the decoded value is equal to one of the enum values.
+func inEnum(v interface{}, enum []interface{}) bool {
+	value := normalizeJSON(v)
+	for _, e := range enum {
+		if reflect.DeepEqual(value, normalizeJSON(e)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeJSON converts the value to its generic decoded json form so that
+// equal json values compare equal with reflect.DeepEqual.
+func normalizeJSON(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var normalized interface{}
+	json.Unmarshal(data, &normalized)
+
+	return normalized
+}
+
+// escapePointer escapes a property name as a JSON Pointer reference token.
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// patternCache caches compiled schema patterns.
+var patternCache sync.Map
+
+// compilePattern compiles the schema pattern.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patternCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Store(pattern, re)
+
+	return re, nil
+}
@@ -0,0 +1,133 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const moveSchema = `{
+    "anyOf": [
+        {
+            "type": "object",
+            "required": ["name", "x"],
+            "properties": {
+                "name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+                "x": {"type": "number", "minimum": 0, "exclusiveMaximum": 100},
+                "mode": {"enum": ["walk", "run"]},
+                "tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}}
+            },
+            "additionalProperties": {"type": "integer"}
+        },
+        {
+            "type": "array",
+            "minItems": 2,
+            "prefixItems": [{"type": "string"}, {"type": "number"}]
+        }
+    ]
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	var schema Schema
+	if err := json.Unmarshal([]byte(moveSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	object := schema.AnyOf[0]
+
+	table := []struct {
+		Params     string
+		Violations []SchemaViolation
+	}{
+		{`{"name": "box", "x": 1.5, "mode": "run", "tags": ["a"], "count": 3}`, nil},
+		{`{"x": -1}`, []SchemaViolation{
+			{"", "required", `missing required property "name"`},
+			{"/x", "minimum", "-1 is less than 0"},
+		}},
+		{`{"name": "Big Box!", "x": 100}`, []SchemaViolation{
+			{"/name", "pattern", `value does not match pattern "^[a-z]+$"`},
+			{"/x", "exclusiveMaximum", "100 is not less than 100"},
+		}},
+		{`{"name": "", "x": "one", "mode": "fly", "tags": ["a", 2, "c"], "a/b": 1.5}`, []SchemaViolation{
+			{"/a~1b", "type", "expected integer, got number"},
+			{"/mode", "enum", "value is not one of the allowed values"},
+			{"/name", "minLength", "length 0 is less than 1"},
+			{"/name", "pattern", `value does not match pattern "^[a-z]+$"`},
+			{"/tags", "maxItems", "3 items is greater than 2"},
+			{"/tags/1", "type", "expected string, got integer"},
+			{"/x", "type", "expected number, got string"},
+		}},
+		{`[1, 2]`, []SchemaViolation{{"", "type", "expected object, got array"}}},
+		{``, []SchemaViolation{{"", "type", "expected object, got null"}}},
+	}
+
+	for _, tc := range table {
+		violations := object.Validate(json.RawMessage(tc.Params))
+		if !reflect.DeepEqual(violations, tc.Violations) {
+			t.Fatalf("Unexpected violations for %s: %+v", tc.Params, violations)
+		}
+	}
+
+	if violations := schema.Validate(json.RawMessage(`["box", 2, true]`)); violations != nil {
+		t.Fatalf("Expected positional params to match, got %+v", violations)
+	}
+	violations := schema.Validate(json.RawMessage(`["box"]`))
+	if len(violations) != 1 || violations[0].Keyword != "anyOf" {
+		t.Fatalf("Expected anyOf violation, got %+v", violations)
+	}
+}
+
+func TestSchemaValidationBeforeCall(t *testing.T) {
+	var schema Schema
+	if err := json.Unmarshal([]byte(moveSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	c := newTestServer(t, func(ts *testServer) {
+		ts.RegisterWithContext("move", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				called = true
+				return "moved", nil
+			},
+			Schema: schema.AnyOf[0],
+		})
+	}).client
+
+	err := c.Call(context.Background(), "move", map[string]interface{}{"name": "box", "x": "one"}, nil)
+	errObj, ok := err.(*ErrorObject)
+	if !ok || errObj.Code != InvalidParamsCode {
+		t.Fatalf("Expected invalid params error, got %v", err)
+	}
+	data, _ := json.Marshal(errObj.Data)
+	if string(data) != `[{"error":"expected number, got string","instanceLocation":"/x","keyword":"type"}]` {
+		t.Fatalf("Unexpected error data %s", data)
+	}
+	if called {
+		t.Fatal("Expected method to not be called")
+	}
+
+	var result string
+	if err := c.Call(context.Background(), "move", map[string]interface{}{"name": "box", "x": 1}, &result); err != nil || result != "moved" {
+		t.Fatalf("Expected method to be called, got %q %v", result, err)
+	}
+}
+
+func TestSchemaInvalidPattern(t *testing.T) {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{"name": {Type: "string", Pattern: "("}}}
+	if err := schema.Check(); err == nil {
+		t.Fatal("Expected invalid pattern error")
+	}
+	c := newTestServer(t, func(ts *testServer) {
+		ts.RegisterWithContext("move", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				return "moved", nil
+			},
+			Schema: schema,
+		})
+	}).client
+
+	err := c.Call(context.Background(), "move", map[string]interface{}{"name": "box"}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != InternalErrorCode {
+		t.Fatalf("Expected internal error, got %v", err)
+	}
+}
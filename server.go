@@ -21,15 +21,17 @@
 package jrpc2
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -37,25 +39,41 @@ import (
 
 // Error codes
 const (
-	ParseErrorCode     ErrorCode = -32700
-	InvalidRequestCode ErrorCode = -32600
-	MethodNotFoundCode ErrorCode = -32601
-	InvalidParamsCode  ErrorCode = -32602
-	InternalErrorCode  ErrorCode = -32603
-	MethodExistsCode   ErrorCode = -32000
-	URLSchemeErrorCode ErrorCode = -32001
+	ParseErrorCode         ErrorCode = -32700
+	InvalidRequestCode     ErrorCode = -32600
+	MethodNotFoundCode     ErrorCode = -32601
+	InvalidParamsCode      ErrorCode = -32602
+	InternalErrorCode      ErrorCode = -32603
+	MethodExistsCode       ErrorCode = -32000
+	URLSchemeErrorCode     ErrorCode = -32001
+	SubscriptionErrorCode  ErrorCode = -32002
+	BackendUnavailableCode ErrorCode = -32003
+	BackendTimeoutCode     ErrorCode = -32004
+	BackendErrorCode       ErrorCode = -32005
+	CircuitOpenCode        ErrorCode = -32006
+	UnauthorizedCode       ErrorCode = -32007
+	ForbiddenCode          ErrorCode = -32008
+	RequestCancelledCode   ErrorCode = -32800
 )
 
 // Error message
 const (
-	ParseErrorMsg     ErrorMsg = "Parse error"
-	InvalidRequestMsg ErrorMsg = "Invalid Request"
-	MethodNotFoundMsg ErrorMsg = "Method not found"
-	InvalidParamsMsg  ErrorMsg = "Invalid params"
-	InternalErrorMsg  ErrorMsg = "Internal error"
-	ServerErrorMsg    ErrorMsg = "Server error"
-	MethodExistsMsg   ErrorMsg = "Method exists"
-	URLSchemeErrorMsg ErrorMsg = "URL scheme error"
+	ParseErrorMsg         ErrorMsg = "Parse error"
+	InvalidRequestMsg     ErrorMsg = "Invalid Request"
+	MethodNotFoundMsg     ErrorMsg = "Method not found"
+	InvalidParamsMsg      ErrorMsg = "Invalid params"
+	InternalErrorMsg      ErrorMsg = "Internal error"
+	ServerErrorMsg        ErrorMsg = "Server error"
+	MethodExistsMsg       ErrorMsg = "Method exists"
+	URLSchemeErrorMsg     ErrorMsg = "URL scheme error"
+	SubscriptionErrorMsg  ErrorMsg = "Subscription error"
+	BackendUnavailableMsg ErrorMsg = "Backend unavailable"
+	BackendTimeoutMsg     ErrorMsg = "Backend timeout"
+	BackendErrorMsg       ErrorMsg = "Backend error"
+	CircuitOpenMsg        ErrorMsg = "Circuit open"
+	UnauthorizedMsg       ErrorMsg = "Unauthorized"
+	ForbiddenMsg          ErrorMsg = "Forbidden"
+	RequestCancelledMsg   ErrorMsg = "Request cancelled"
 )
 
 // ErrorCode is a json rpc 2.0 error code.
@@ -73,6 +91,7 @@ type ErrorObject struct {
 	Code    ErrorCode   `json:"code"`
 	Message ErrorMsg    `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
+	err     error
 }
 
 // RequestObject represents a request object
@@ -109,10 +128,45 @@ type Params interface {
 }
 
 // ParseParams processes the params data structure from the request.
+// Named parameters will be umarshaled into the provided params value, which must
+// be a non-nil pointer.
+//
+// Positional parameters are assigned to the fields of a params struct. Field positions
+// and required parameters are declared with the jrpc struct tag:
+//
+//	type AddParams struct {
+//		X *float64 `json:"x" jrpc:"pos=0,required"`
+//		Y *float64 `json:"y" jrpc:"pos=1"`
+//	}
+//
+// If no field declares a position, exported fields are assigned in declaration order.
+// Params types without jrpc tags that implement the Params interface are passed the
+// positional arguments through their FromPositional method instead.
+func ParseParams(params json.RawMessage, p interface{}) *ErrorObject {
+	if pp, ok := p.(Params); ok && !hasParamTags(reflect.TypeOf(p)) {
+		return parsePositional(params, pp)
+	}
+
+	ptr := reflect.ValueOf(p)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return &ErrorObject{
+			Code:    InternalErrorCode,
+			Message: InternalErrorMsg,
+			Data:    fmt.Sprintf("params must be a non-nil pointer, got %T", p),
+		}
+	}
+	if err := unmarshalParams(params, ptr); err != nil {
+		return paramsError(err)
+	}
+
+	return nil
+}
+
+// parsePositional processes the params of a Params implementation.
 // Named parameters will be umarshaled into the provided Params inteface.
 // Positional arguments will be passed to Params interface's FromPositional method for
 // extraction.
-func ParseParams(params json.RawMessage, p Params) *ErrorObject {
+func parsePositional(params json.RawMessage, p Params) *ErrorObject {
 	if err := json.Unmarshal(params, p); err != nil {
 		errObj := &ErrorObject{
 			Code:    InvalidParamsCode,
@@ -133,6 +187,25 @@ func ParseParams(params json.RawMessage, p Params) *ErrorObject {
 	return nil
 }
 
+// paramsError creates the error object for a params decoding error.
+// Invalid jrpc struct tags are reported as internal errors.
+func paramsError(err error) *ErrorObject {
+	var tagErr *paramTagError
+	if errors.As(err, &tagErr) {
+		return &ErrorObject{
+			Code:    InternalErrorCode,
+			Message: InternalErrorMsg,
+			Data:    err.Error(),
+		}
+	}
+
+	return &ErrorObject{
+		Code:    InvalidParamsCode,
+		Message: InvalidParamsMsg,
+		Data:    err.Error(),
+	}
+}
+
 // NewResponse creates a bytes encoded representation of a response.
 // Both result and error response objects can be created.
 // The nl flag specifies if the response should be newline terminated.
@@ -157,15 +230,23 @@ func NewResponse(result interface{}, errObj *ErrorObject, id interface{}, nl boo
 type Batch struct {
 	// Responses contains the byte representations of a batch of responses.
 	Responses [][]byte
+	mu        sync.Mutex
 }
 
 // AddResponse inserts the response into the batch responses.
+// It is safe to call AddResponse from multiple goroutines.
 func (b *Batch) AddResponse(resp []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.Responses = append(b.Responses, resp)
 }
 
 // MakeResponse creates a bytes encoded representation of a response object.
 func (b *Batch) MakeResponse() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	var resp bytes.Buffer
 	resp.WriteString("[")
 
@@ -193,22 +274,100 @@ type Method struct {
 type MethodWithContext struct {
 	// Url is the url of the server that handles the method.
 	// Method is the callable function
-	Url    string
-	Method func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject)
+	// Interceptors run around the calls of the method, after the server interceptors.
+	// Schema is the JSON Schema that the params are validated against before the
+	// method is called. The params are not validated if it is nil. Calls fail with
+	// an internal error if the schema is invalid.
+	// Backends contains the backend servers of a method proxied to more than one
+	// server, which are used instead of Url.
+	// Balancer balances the calls between the backends, overriding the server
+	// balancer.
+	// Proxy configures the calls to the backends, overriding the server proxy
+	// configuration.
+	Url          string
+	Method       func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject)
+	Interceptors []Interceptor
+	Schema       *Schema
+	Backends     []Backend
+	Balancer     Balancer
+	Proxy        *ProxyConfig
+	paramsType   reflect.Type
+	resultType   reflect.Type
 }
 
 // Server represents a jsonrpc 2.0 capable web server.
 type Server struct {
 	// Host is the host:port of the server.
 	// Route is the path to the rpc api.
-	// Methods contains the mapping of registered methods.
+	// Methods contains methods that are added to the method registry when the
+	// server is prepared, or when it first calls, looks up or removes a method.
+	// Deprecated: Methods is only read once. Register methods with Register,
+	// RegisterWithContext or RegisterFunc, and read them with Lookup and List.
 	// Headers contains response headers.
-	Host       string
-	Route      string
-	Methods    map[string]MethodWithContext
-	Headers    map[string]string
-	httpServer *http.Server
-	mux        *http.ServeMux
+	// WebSocketRoute is the path to the websocket rpc api, which is not served if empty.
+	// CancelMethod is the name of the notification that cancels a request in flight on
+	// a persistent connection. Request cancellation is disabled if empty.
+	// OrderedBatch returns batch responses in the order of their requests instead of
+	// the order they complete.
+	// MaxBatchSize is the maximum number of requests in a batch, unlimited if zero.
+	// MaxBatchParallelism is the maximum number of requests of a batch called at the
+	// same time, unlimited if zero.
+	// StreamBatch writes each http batch response as soon as it is available instead
+	// of buffering the batch response.
+	// Debug includes the stack trace of a recovered method panic in the error data.
+	// PanicHandler is called with the value and stack trace of each panic recovered
+	// from a method call. The panic is logged if it is nil.
+	// RedactErrors removes the data of internal errors wrapping errors that aren't
+	// mapped to an error object.
+	// Info describes the api in the OpenRPC document returned by rpc.discover.
+	// HealthCheck configures the health probing of the backends of proxied methods.
+	// Backends are not probed if it is nil.
+	// Balancer balances the calls to proxied methods between their backends,
+	// RoundRobin if nil.
+	// Proxy configures the calls of proxied methods to their backends. It must not
+	// be changed once the server is prepared.
+	// CircuitBreaker configures the circuit breakers of the backends of proxied
+	// methods. Circuits never open if it is nil.
+	// RegistryStore persists the proxied methods, which are loaded from it when the
+	// server is prepared. Proxied methods are not persisted if it is nil.
+	// Registration controls who may call the registry methods and which methods
+	// they may register. Anyone may register any method if it is nil.
+	Host                string
+	Route               string
+	Methods             map[string]MethodWithContext
+	Headers             map[string]string
+	WebSocketRoute      string
+	CancelMethod        string
+	OrderedBatch        bool
+	MaxBatchSize        int
+	MaxBatchParallelism int
+	StreamBatch         bool
+	Debug               bool
+	PanicHandler        func(ctx context.Context, req *RequestObject, v interface{}, stack []byte)
+	RedactErrors        bool
+	Info                OpenRPCInfo
+	HealthCheck         *HealthCheck
+	Balancer            Balancer
+	Proxy               *ProxyConfig
+	CircuitBreaker      *CircuitBreaker
+	RegistryStore       RegistryStore
+	Registration        *RegistrationPolicy
+	httpServer          *http.Server
+	mux                 *http.ServeMux
+	proxyClients        sync.Map
+	proxyHTTPClients    sync.Map
+	pubsub              *pubsub
+	methods             *registry
+	interceptors        []Interceptor
+	errorMappings       []errorMapping
+	health              *healthMonitor
+	circuits            *circuitBreakers
+	storeLoad           sync.Once
+	methodsImport       sync.Once
+	storeMu             sync.Mutex
+	defaultBalancer     Balancer
+	backendCalls        sync.Map
+	webSockets          webSocketSet
 }
 
 // rpcHandler handles incoming rpc client requests.
@@ -225,55 +384,248 @@ func (s *Server) rpcHandler(w http.ResponseWriter, r *http.Request) {
 
 // HandleRequest validates, calls, and returns the result of a single rpc client request.
 func (s *Server) HandleRequest(w http.ResponseWriter, req *RequestObject) {
+	if resp := s.handleRequest(req); resp != nil {
+		w.Write(resp)
+	}
+}
+
+// handleRequest validates and calls a single rpc client request and returns the
+// encoded response, or nil if the request is a notification.
+func (s *Server) handleRequest(req *RequestObject) []byte {
 	if err := s.ValidateRequest(req); err != nil {
-		w.Write(NewResponse(nil, err, req.Id, true))
-		return
+		return NewResponse(nil, err, req.Id, true)
 	}
 
-	if result, err := s.Call(req.ctx, req.Method, req.Params); err != nil {
-		w.Write(NewResponse(nil, err, req.Id, true))
-		return
+	if result, err := s.call(req); err != nil {
+		return NewResponse(nil, err, req.Id, true)
 	} else if req.Id != nil {
-		w.Write(NewResponse(result, nil, req.Id, true))
+		return NewResponse(result, nil, req.Id, true)
 	}
+
+	return nil
+}
+
+// call invokes the method of a validated request through the interceptors. The
+// result of a request cancelled by the client is replaced by a RequestCancelledCode
+// error, and a panic is recovered and replaced by an InternalErrorCode error. A
+// request without a context, such as one built by the caller, is called with the
+// background context.
+func (s *Server) call(req *RequestObject) (result interface{}, errObj *ErrorObject) {
+	s.importMethods()
+	if req.ctx == nil {
+		req.ctx = context.Background()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			result, errObj = nil, s.recoverPanic(req, v)
+		}
+	}()
+
+	result, errObj = s.intercept(req.ctx, req)
+	errObj = s.resolveError(errObj)
+	if err := cancelledError(req.ctx); err != nil {
+		return nil, err
+	}
+
+	return result, errObj
+}
+
+// recoverPanic reports the panic value recovered from the call of the request
+// method and returns the internal error that replaces the call result.
+func (s *Server) recoverPanic(req *RequestObject, v interface{}) *ErrorObject {
+	stack := debug.Stack()
+	if s.PanicHandler != nil {
+		s.PanicHandler(req.ctx, req, v, stack)
+	} else {
+		log.Printf("jrpc2: panic calling method %v: %v\n%s", req.Method, v, stack)
+	}
+
+	errObj := &ErrorObject{
+		Code:    InternalErrorCode,
+		Message: InternalErrorMsg,
+	}
+	if s.Debug {
+		errObj.Data = fmt.Sprintf("panic: %v\n\n%s", v, stack)
+	}
+
+	return errObj
 }
 
 // HandleBatch validates, calls, and returns the results of a batch of rpc client requests.
 // Batch methods are called in individual goroutines and collected in a single response.
+// The responses are in request order if the server OrderedBatch option is set, and
+// are streamed to the client as they complete if the StreamBatch option is set.
 func (s *Server) HandleBatch(w http.ResponseWriter, reqs []*RequestObject) {
 	w.Header().Set("Content-Type", "application/json")
+	if f, ok := w.(http.Flusher); ok && s.StreamBatch {
+		s.streamBatch(w, f, reqs)
+		return
+	}
+	if resp := s.handleBatch(reqs); resp != nil {
+		w.Write(resp)
+	}
+}
+
+// checkBatch returns an invalid request error if the batch is empty or exceeds the
+// maximum batch size.
+func (s *Server) checkBatch(reqs []*RequestObject) *ErrorObject {
 	if len(reqs) < 1 {
-		err := &ErrorObject{
+		return &ErrorObject{
 			Code:    InvalidRequestCode,
 			Message: InvalidRequestMsg,
 			Data:    `Batch must contain at least one request`,
 		}
-		w.Write(NewResponse(nil, err, nil, true))
+	}
+	if s.MaxBatchSize > 0 && len(reqs) > s.MaxBatchSize {
+		return &ErrorObject{
+			Code:    InvalidRequestCode,
+			Message: InvalidRequestMsg,
+			Data:    fmt.Sprintf("Batch must contain at most %d requests", s.MaxBatchSize),
+		}
+	}
+
+	return nil
+}
+
+// handleBatch validates and calls a batch of rpc client requests and returns the
+// encoded batch response, or nil if the batch only contains notifications.
+func (s *Server) handleBatch(reqs []*RequestObject) []byte {
+	if err := s.checkBatch(reqs); err != nil {
+		return NewResponse(nil, err, nil, true)
 	}
 
-	var wg sync.WaitGroup
 	batch := new(Batch)
+	if s.OrderedBatch {
+		slots := make([][]byte, len(reqs))
+		s.runBatch(reqs, func(i int, resp []byte) {
+			slots[i] = resp
+		})
+		for _, resp := range slots {
+			if resp != nil {
+				batch.AddResponse(resp)
+			}
+		}
+	} else {
+		s.runBatch(reqs, func(i int, resp []byte) {
+			if resp != nil {
+				batch.AddResponse(resp)
+			}
+		})
+	}
 
-	for _, req := range reqs {
+	if len(batch.Responses) > 0 {
+		return batch.MakeResponse()
+	}
+
+	return nil
+}
+
+// runBatch validates and calls each request of a batch and passes the encoded
+// response with the index of its request to emit. The response is nil for
+// notifications. Requests are called in individual goroutines, at most
+// MaxBatchParallelism at a time, and runBatch returns once all calls complete.
+// Proxied calls of the batch are forwarded through a batch forwarder.
+func (s *Server) runBatch(reqs []*RequestObject, emit func(i int, resp []byte)) {
+	var wg sync.WaitGroup
+	var sem chan struct{}
+	if s.MaxBatchParallelism > 0 {
+		sem = make(chan struct{}, s.MaxBatchParallelism)
+	}
+	forwarder := s.newBatchForwarder()
+
+	for i, req := range reqs {
 		if err := s.ValidateRequest(req); err != nil {
-			batch.AddResponse(NewResponse(nil, err, req.Id, false))
+			emit(i, NewResponse(nil, err, req.Id, false))
 			continue
 		}
 
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				// the running requests may wait to forward their proxied
+				// calls until the dispatch is no longer active
+				forwarder.end()
+				sem <- struct{}{}
+				forwarder.begin()
+			}
+		}
+		req.ctx = forwarder.context(req.ctx)
+		forwarder.begin()
 		wg.Add(1)
-		go func(req *RequestObject) {
+		go func(i int, req *RequestObject) {
 			defer wg.Done()
-			if result, err := s.Call(req.ctx, req.Method, req.Params); err != nil {
-				batch.AddResponse(NewResponse(nil, err, req.Id, false))
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			result, err := s.call(req)
+			forwarder.end()
+			if err != nil {
+				emit(i, NewResponse(nil, err, req.Id, false))
 			} else if req.Id != nil {
-				batch.AddResponse(NewResponse(result, nil, req.Id, false))
+				emit(i, NewResponse(result, nil, req.Id, false))
+			} else {
+				emit(i, nil)
 			}
-		}(req)
+		}(i, req)
 	}
+	forwarder.end()
 
 	wg.Wait()
-	if len(batch.Responses) > 0 {
-		w.Write(batch.MakeResponse())
+}
+
+// streamBatch validates and calls a batch of rpc client requests and writes each
+// response of the batch array as soon as it is available, flushing after every
+// response. The array is opened when the first response is written, so nothing is
+// written if the batch only contains notifications.
+func (s *Server) streamBatch(w io.Writer, f http.Flusher, reqs []*RequestObject) {
+	if err := s.checkBatch(reqs); err != nil {
+		w.Write(NewResponse(nil, err, nil, true))
+		return
+	}
+
+	var mu sync.Mutex
+	written := 0
+	write := func(resp []byte) {
+		if written == 0 {
+			io.WriteString(w, "[")
+		} else {
+			io.WriteString(w, ",")
+		}
+		w.Write(resp)
+		f.Flush()
+		written++
+	}
+
+	emit := func(i int, resp []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if resp != nil {
+			write(resp)
+		}
+	}
+	if s.OrderedBatch {
+		// responses are held until all responses of the preceding requests
+		// have been written
+		done := make([]bool, len(reqs))
+		slots := make([][]byte, len(reqs))
+		next := 0
+		emit = func(i int, resp []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			slots[i], done[i] = resp, true
+			for ; next < len(reqs) && done[next]; next++ {
+				if slots[next] != nil {
+					write(slots[next])
+					slots[next] = nil
+				}
+			}
+		}
+	}
+
+	s.runBatch(reqs, emit)
+	if written > 0 {
+		io.WriteString(w, "]\n")
 	}
 }
 
@@ -281,27 +633,59 @@ func (s *Server) HandleBatch(w http.ResponseWriter, reqs []*RequestObject) {
 type RegisterRPCParams struct {
 	// Name is the the name of the method being registered.
 	// Url is the url of the server that handles the method.
-	Name *string
-	Url  *string
+	// TTL is the number of seconds the registration lasts unless it is renewed by a
+	// heartbeat. The registration lasts until it is unregistered if it is nil.
+	// Weight is the weight of the server for the weighted balancer.
+	Name   *string  `json:"name" jrpc:"pos=0,required"`
+	Url    *string  `json:"url" jrpc:"pos=1,required"`
+	TTL    *float64 `json:"ttl" jrpc:"pos=2"`
+	Weight *int     `json:"weight" jrpc:"pos=3"`
 }
 
 // FromPositional extracts the positional name and url parameters from a list of
 // parameters.
+//
+// Deprecated: ParseParams assigns positional parameters using the struct tags of
+// RegisterRPCParams.
 func (rp *RegisterRPCParams) FromPositional(params []interface{}) error {
-	if len(params) != 2 {
+	if len(params) < 2 || len(params) > 4 {
 		return errors.New("register requires name and url parameters")
 	}
 
-	name := params[0].(string)
-	url := params[1].(string)
+	name, ok := params[0].(string)
+	if !ok {
+		return errors.New("register name parameter must be a string")
+	}
+	url, ok := params[1].(string)
+	if !ok {
+		return errors.New("register url parameter must be a string")
+	}
 	rp.Name = &name
 	rp.Url = &url
+	if len(params) >= 3 {
+		ttl, ok := params[2].(float64)
+		if !ok {
+			return errors.New("register ttl parameter must be a number")
+		}
+		rp.TTL = &ttl
+	}
+	if len(params) == 4 {
+		weight, ok := params[3].(float64)
+		if !ok {
+			return errors.New("register weight parameter must be a number")
+		}
+		w := int(weight)
+		rp.Weight = &w
+	}
 
 	return nil
 }
 
-// RegisterRPC accepts a method name and server url to register a proxy rpc method.
-// A method name can be only be registered once.
+// RegisterRPC accepts a method name and server url to register a proxy rpc method,
+// and an optional ttl after which the registration expires unless it is renewed by
+// a heartbeat. Registering a proxied method again with another server url adds a
+// backend to the method. A server url can only be registered once per method.
+// Registrations are authorized and audited by the server Registration policy.
 func (s *Server) RegisterRPC(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
 	p := new(RegisterRPCParams)
 
@@ -309,29 +693,222 @@ func (s *Server) RegisterRPC(ctx context.Context, params json.RawMessage) (inter
 		return nil, err
 	}
 
+	principal, err := s.authorize(ctx, "jrpc2.register", params, *p.Name, *p.Url)
+	if err == nil {
+		err = s.registerProxied(p)
+	}
+	s.audit(ctx, AuditRecord{Action: "register", Principal: principal, Name: *p.Name, Url: *p.Url, Error: err})
+	if err != nil {
+		return nil, err
+	}
+
+	return "success", nil
+}
+
+// registerProxied adds the backend of the registration to the proxied method.
+func (s *Server) registerProxied(p *RegisterRPCParams) *ErrorObject {
 	if !strings.HasPrefix(*p.Url, "http://") && !strings.HasPrefix(*p.Url, "https://") {
-		return nil, &ErrorObject{
+		return &ErrorObject{
 			Code:    URLSchemeErrorCode,
 			Message: URLSchemeErrorMsg,
 			Data:    "url scheme must match http?s://",
 		}
 	}
+	if p.TTL != nil && *p.TTL <= 0 {
+		return &ErrorObject{
+			Code:    InvalidParamsCode,
+			Message: InvalidParamsMsg,
+			Data:    "ttl must be positive",
+		}
+	}
 
-	if _, ok := s.Methods[*p.Name]; ok {
-		return nil, &ErrorObject{
+	backend := Backend{Url: *p.Url}
+	if p.Weight != nil {
+		backend.Weight = *p.Weight
+	}
+	added := s.methods.update(*p.Name, func(m MethodWithContext, exists bool) (MethodWithContext, bool) {
+		m, ok := addBackend(m, exists, backend)
+		if ok && p.TTL != nil {
+			// the lease is set before the registry hooks are called so that the
+			// registry store persists the ttl.
+			s.health.setLease(*p.Name, *p.Url, time.Duration(*p.TTL*float64(time.Second)))
+		}
+		return m, ok
+	})
+	if !added {
+		return &ErrorObject{
 			Code:    MethodExistsCode,
 			Message: MethodExistsMsg,
 		}
 	}
 
-	s.Methods[*p.Name] = MethodWithContext{Url: *p.Url}
+	return nil
+}
+
+// addBackend adds the backend to the proxied method m, or creates a proxied method
+// if the method doesn't exist. It returns false if m is a local method or already
+// has a backend with the url.
+func addBackend(m MethodWithContext, exists bool, backend Backend) (MethodWithContext, bool) {
+	if !exists {
+		if backend.Weight != 0 {
+			return MethodWithContext{Backends: []Backend{backend}}, true
+		}
+		return MethodWithContext{Url: backend.Url}, true
+	}
+	backends := m.backends()
+	if backends == nil {
+		return m, false
+	}
+	for _, b := range backends {
+		if b.Url == backend.Url {
+			return m, false
+		}
+	}
+
+	m.Url, m.Backends = "", append(append([]Backend(nil), backends...), backend)
+	return m, true
+}
+
+// UnregisterRPCParams is a paramater spec for the UnregisterRPC method.
+type UnregisterRPCParams struct {
+	// Name is the the name of the method being unregistered.
+	// Url is the url of the server that handles the method. If provided, only the
+	// backend with the url is removed from the method.
+	Name *string `json:"name" jrpc:"pos=0,required"`
+	Url  *string `json:"url" jrpc:"pos=1"`
+}
+
+// UnregisterRPC accepts a method name, and optionally a server url, to unregister
+// a proxy rpc method or to remove one of its backends. A method is unregistered
+// when its last backend is removed. Only proxied methods can be unregistered.
+// Unregistrations are authorized and audited by the server Registration policy.
+func (s *Server) UnregisterRPC(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	p := new(UnregisterRPCParams)
+
+	if err := ParseParams(params, p); err != nil {
+		return nil, err
+	}
+
+	url := ""
+	if p.Url != nil {
+		url = *p.Url
+	}
+	principal, err := s.authorize(ctx, "jrpc2.unregister", params, *p.Name, "")
+	if err == nil {
+		err = s.unregisterProxied(p)
+	}
+	s.audit(ctx, AuditRecord{Action: "unregister", Principal: principal, Name: *p.Name, Url: url, Error: err})
+	if err != nil {
+		return nil, err
+	}
 
 	return "success", nil
 }
 
+// unregisterProxied removes the proxied method, or its backend if a url is given.
+func (s *Server) unregisterProxied(p *UnregisterRPCParams) *ErrorObject {
+	method, ok := s.methods.lookup(*p.Name)
+	if !ok {
+		return &ErrorObject{
+			Code:    MethodNotFoundCode,
+			Message: MethodNotFoundMsg,
+		}
+	}
+	if method.backends() == nil {
+		return &ErrorObject{
+			Code:    InvalidParamsCode,
+			Message: InvalidParamsMsg,
+			Data:    "only proxied methods can be unregistered",
+		}
+	}
+
+	var removed bool
+	if p.Url != nil {
+		removed = s.removeProxied(*p.Name, *p.Url)
+	} else {
+		removed = s.methods.remove(*p.Name, func(m MethodWithContext) bool {
+			return m.backends() != nil
+		})
+	}
+	if !removed {
+		return &ErrorObject{
+			Code:    InvalidParamsCode,
+			Message: InvalidParamsMsg,
+			Data:    "url does not match the registered url",
+		}
+	}
+
+	return nil
+}
+
 // Register maps the provided method to the given name for later method calls.
 func (s *Server) Register(name string, method Method) {
-	s.Methods[name] = MethodWithContext{
+	s.methods.set(name, withContext(method))
+}
+
+// RegisterWithContext maps the provided method to the given name for later method calls.
+func (s *Server) RegisterWithContext(name string, method MethodWithContext) {
+	s.methods.set(name, method)
+}
+
+// RegisterFunc maps the typed function fn to the given name for later method calls.
+// See NewFuncMethod for the accepted function signature.
+func (s *Server) RegisterFunc(name string, fn interface{}) error {
+	method, err := NewFuncMethod(fn)
+	if err != nil {
+		return err
+	}
+	s.methods.set(name, method)
+
+	return nil
+}
+
+// Unregister removes the method registered under the given name and reports whether
+// it was registered.
+func (s *Server) Unregister(name string) bool {
+	s.importMethods()
+	return s.methods.remove(name, nil)
+}
+
+// Replace replaces the method registered under the given name and reports whether a
+// method was registered under it. No method is registered if it was not.
+func (s *Server) Replace(name string, method MethodWithContext) bool {
+	s.importMethods()
+	return s.methods.replace(name, method)
+}
+
+// Lookup returns the method registered under the given name.
+func (s *Server) Lookup(name string) (MethodWithContext, bool) {
+	s.importMethods()
+	return s.methods.lookup(name)
+}
+
+// List returns the sorted names of the registered methods.
+func (s *Server) List() []string {
+	s.importMethods()
+	return s.methods.list()
+}
+
+// OnRegistryChange adds a hook that is called after every change made to the
+// registered methods. Hooks are called synchronously by the goroutine making the
+// change.
+func (s *Server) OnRegistryChange(hook func(RegistryEvent)) {
+	s.methods.onChange(hook)
+}
+
+// importMethods adds the methods of the deprecated Methods field to the method
+// registry. The field is only read once, by the first call of importMethods.
+func (s *Server) importMethods() {
+	s.methodsImport.Do(func() { s.methods.importMethods(s.Methods) })
+}
+
+// withContext converts the method to a method with a context.
+func withContext(method Method) MethodWithContext {
+	if method.Method == nil {
+		return MethodWithContext{Url: method.Url}
+	}
+
+	return MethodWithContext{
 		Url: method.Url,
 		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
 			return method.Method(params)
@@ -339,16 +916,9 @@ func (s *Server) Register(name string, method Method) {
 	}
 }
 
-func (s *Server) RegisterWithContext(name string, method MethodWithContext) {
-	s.Methods[name] = method
-}
-
 // ParseRequest parses the json request body and unpacks into one or more.
 // RequestObjects for single or batch processing.
 func (s *Server) ParseRequest(w http.ResponseWriter, r *http.Request) *ErrorObject {
-	var errObj *ErrorObject
-	req := new(RequestObject)
-
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return &ErrorObject{
@@ -358,33 +928,50 @@ func (s *Server) ParseRequest(w http.ResponseWriter, r *http.Request) *ErrorObje
 		}
 	}
 
-	if err := json.Unmarshal(data, req); err != nil {
-		errObj = &ErrorObject{
+	req, reqs, errObj := decodeRequest(data)
+	if errObj != nil {
+		return errObj
+	}
+
+	ctx := context.WithValue(r.Context(), httpRequestKey{}, r)
+	if req != nil {
+		req.ctx = ctx
+		s.HandleRequest(w, req)
+		return nil
+	}
+
+	for _, req := range reqs {
+		req.ctx = ctx
+	}
+	s.HandleBatch(w, reqs)
+
+	return nil
+}
+
+// decodeRequest decodes the json data as a single request or, failing that, as a
+// batch of requests.
+func decodeRequest(data []byte) (*RequestObject, []*RequestObject, *ErrorObject) {
+	req := new(RequestObject)
+	if err := json.Unmarshal(data, req); err == nil {
+		return req, nil, nil
+	}
+
+	var reqs []*RequestObject
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		return nil, nil, &ErrorObject{
 			Code:    ParseErrorCode,
 			Message: ParseErrorMsg,
 			Data:    err.Error(),
 		}
-	} else {
-		req.ctx = r.Context()
-		s.HandleRequest(w, req)
 	}
 
-	if errObj != nil {
-		var reqs []*RequestObject
-		if err := json.Unmarshal(data, &reqs); err != nil {
-			errObj = &ErrorObject{
-				Code:    ParseErrorCode,
-				Message: ParseErrorMsg,
-				Data:    err.Error(),
-			}
-			return errObj
+	for i, req := range reqs {
+		if req == nil {
+			reqs[i] = new(RequestObject)
 		}
-
-		errObj = nil
-		s.HandleBatch(w, reqs)
 	}
 
-	return errObj
+	return nil, reqs, nil
 }
 
 // ValidateRequest validates that the request json contains valid values.
@@ -405,7 +992,7 @@ func (s *Server) ValidateRequest(req *RequestObject) *ErrorObject {
 		}
 	}
 
-	if strings.HasPrefix(req.Method.(string), "rpc.") {
+	if strings.HasPrefix(req.Method.(string), "rpc.") && req.Method != DiscoverMethod {
 		return &ErrorObject{
 			Code:    InvalidRequestCode,
 			Message: InvalidRequestMsg,
@@ -417,53 +1004,45 @@ func (s *Server) ValidateRequest(req *RequestObject) *ErrorObject {
 }
 
 // Call invokes the named method with the provided parameters.
-// If a method from the server Methods has a Method member will be called locally.
-// If a method from the server Methods has a Url member it will be called by proxy.
+// If a registered method has a Method member will be called locally.
+// If a registered method has a Url member it will be called by proxy.
 func (s *Server) Call(ctx context.Context, name interface{}, params json.RawMessage) (interface{}, *ErrorObject) {
-	method, ok := s.Methods[name.(string)]
+	s.importMethods()
+	if s.CancelMethod != "" && name == s.CancelMethod {
+		return s.CancelRequest(ctx, params)
+	}
+	if name == DiscoverMethod {
+		return s.Discover(ctx, params)
+	}
+
+	method, ok := s.methods.lookup(name.(string))
 	if !ok {
 		return nil, &ErrorObject{
 			Code:    MethodNotFoundCode,
 			Message: MethodNotFoundMsg,
 		}
 	}
-	if method.Method != nil {
-		return method.Method(ctx, params)
-	}
-	if method.Url != "" {
-		req := &RequestObject{
-			Jsonrpc: "2.0",
-			Method:  name,
-			Params:  params,
-			Id:      "1",
-		}
-		body, err := json.Marshal(req)
-		if err != nil {
+	if method.Schema != nil {
+		if err := method.Schema.Check(); err != nil {
 			return nil, &ErrorObject{
 				Code:    InternalErrorCode,
 				Message: InternalErrorMsg,
 				Data:    err.Error(),
 			}
 		}
-		data, err := http.Post(method.Url, "application/json", bytes.NewBuffer(body))
-		if err != nil {
+		if violations := method.Schema.Validate(params); len(violations) > 0 {
 			return nil, &ErrorObject{
-				Code:    InternalErrorCode,
-				Message: InternalErrorMsg,
-				Data:    err.Error(),
+				Code:    InvalidParamsCode,
+				Message: InvalidParamsMsg,
+				Data:    violations,
 			}
 		}
-
-		resp := new(ResponseObject)
-		rdr := bufio.NewReader(data.Body)
-		dec := json.NewDecoder(rdr)
-		dec.Decode(&resp)
-
-		if resp.Result != nil {
-			return resp.Result, nil
-		} else if resp.Error != nil {
-			return nil, resp.Error
-		}
+	}
+	if method.Method != nil {
+		return method.Method(ctx, params)
+	}
+	if method.backends() != nil {
+		return s.callProxied(ctx, name.(string), method, params)
 	}
 
 	return nil, &ErrorObject{
@@ -475,17 +1054,30 @@ func (s *Server) Call(ctx context.Context, name interface{}, params json.RawMess
 
 // Prepare prepares the http.Server instance for accepting requests and returns it but doesn't start it yet.
 func (s *Server) Prepare() *http.Server {
+	s.importMethods()
+	s.loadRegistry()
+	s.startHealthChecks()
 	s.mux.HandleFunc(s.Route, s.rpcHandler)
+	if s.WebSocketRoute != "" {
+		s.mux.HandleFunc(s.WebSocketRoute, s.ServeWebSocket)
+	}
 	return s.httpServer
 }
 
 // PrepareWithMiddleware prepares the http.Server instance for accepting requests and returns it but doesn't start it yet.
 func (s *Server) PrepareWithMiddleware(m func(next http.HandlerFunc) http.HandlerFunc) *http.Server {
+	s.importMethods()
+	s.loadRegistry()
+	s.startHealthChecks()
 	s.mux.HandleFunc(s.Route, m(s.rpcHandler))
+	if s.WebSocketRoute != "" {
+		s.mux.HandleFunc(s.WebSocketRoute, m(s.ServeWebSocket))
+	}
 	return s.httpServer
 }
 
 // Start binds the rpcHandler to the server route and starts the http server.
+// It returns once the server is shut down, and exits on any other serve error.
 func (s *Server) Start() {
 	s.Prepare()
 	s.start()
@@ -493,10 +1085,11 @@ func (s *Server) Start() {
 
 func (s *Server) start() {
 	log.Println(fmt.Sprintf("Starting server on %s at %s", s.Host, s.Route))
-	log.Fatal(s.httpServer.ListenAndServe())
+	logServeError(s.httpServer.ListenAndServe())
 }
 
 // StartTLS binds the rpcHandler to the server route and starts the https server.
+// It returns once the server is shut down, and exits on any other serve error.
 func (s *Server) StartTLS(certFile, keyFile string) {
 	s.Prepare()
 	s.startTLS(certFile, keyFile)
@@ -504,7 +1097,7 @@ func (s *Server) StartTLS(certFile, keyFile string) {
 
 func (s *Server) startTLS(certFile, keyFile string) {
 	log.Println(fmt.Sprintf("Starting server on %s at %s", s.Host, s.Route))
-	log.Fatal(s.httpServer.ListenAndServeTLS(certFile, keyFile))
+	logServeError(s.httpServer.ListenAndServeTLS(certFile, keyFile))
 }
 
 // StartWithMiddleware binds the rpcHandler, with its middleware to the server
@@ -521,7 +1114,8 @@ func (s *Server) StartTLSWithMiddleware(certFile, keyFile string, m func(next ht
 	s.startTLS(certFile, keyFile)
 }
 
-// Shutdown stops the server from accepting new requests and shuts down the server.
+// Shutdown stops the server from accepting new requests, closes the open websocket
+// connections and shuts down the server.
 // If timeout is not 0, the given context is wrapped in a new context with the given timeout.
 func (s *Server) Shutdown(ctx context.Context, timeout time.Duration) error {
 	if timeout > 0 {
@@ -529,22 +1123,47 @@ func (s *Server) Shutdown(ctx context.Context, timeout time.Duration) error {
 		ctx, release = context.WithTimeout(ctx, timeout)
 		defer release()
 	}
+	s.health.close()
+	s.webSockets.close()
 	return s.httpServer.Shutdown(ctx)
 }
 
+// logServeError exits with the error returned by a serving http server unless the
+// server was closed by Shutdown.
+func logServeError(err error) {
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
 // NewServer creates a new server instance.
 func NewServer(host, route string, headers map[string]string) *Server {
 	mux := http.NewServeMux()
 	s := &Server{
-		Host:       host,
-		Route:      route,
-		Methods:    make(map[string]MethodWithContext),
-		Headers:    headers,
-		httpServer: &http.Server{Addr: host, Handler: mux},
-		mux:        mux,
+		Host:            host,
+		Route:           route,
+		Methods:         make(map[string]MethodWithContext),
+		Headers:         headers,
+		CancelMethod:    DefaultCancelMethod,
+		httpServer:      &http.Server{Addr: host, Handler: mux},
+		mux:             mux,
+		pubsub:          newPubsub(),
+		methods:         newRegistry(),
+		health:          newHealthMonitor(),
+		circuits:        newCircuitBreakers(),
+		defaultBalancer: RoundRobin(),
 	}
-
-	s.Methods["jrpc2.register"] = MethodWithContext{Method: s.RegisterRPC}
+	s.methods.onChange(s.health.registryChanged)
+	s.methods.onChange(s.balancerChanged)
+	s.methods.onChange(s.proxyChanged)
+
+	s.methods.set("jrpc2.register", MethodWithContext{Method: s.RegisterRPC})
+	s.methods.set("jrpc2.unregister", MethodWithContext{Method: s.UnregisterRPC})
+	s.methods.set("jrpc2.subscribe", MethodWithContext{Method: s.Subscribe})
+	s.methods.set("jrpc2.unsubscribe", MethodWithContext{Method: s.Unsubscribe})
+	s.methods.set("jrpc2.heartbeat", MethodWithContext{Method: s.Heartbeat})
+	s.methods.set("jrpc2.circuits", MethodWithContext{Method: s.CircuitsRPC})
+	s.methods.set(DefaultHealthMethod, MethodWithContext{Method: s.Health})
 
 	return s
 }
@@ -552,69 +1171,185 @@ func NewServer(host, route string, headers map[string]string) *Server {
 // MuxHandler is a method dispatcher that handles request at a
 // designated route.
 type MuxHandler struct {
-	Methods map[string]MethodWithContext
+	// Methods contains methods that are added to the handler methods when a mux
+	// server is prepared.
+	// Deprecated: Methods is only read once, when a mux server is prepared. Register
+	// methods with Register, RegisterWithContext or RegisterFunc, and read them with
+	// Lookup and List.
+	Methods       map[string]MethodWithContext
+	methods       *registry
+	interceptors  []Interceptor
+	methodsInit   sync.Once
+	methodsImport sync.Once
+}
+
+// registry returns the handler methods, which are created on first use so that
+// handlers created without NewMuxHandler can be used.
+func (h *MuxHandler) registry() *registry {
+	h.methodsInit.Do(func() {
+		if h.methods == nil {
+			h.methods = newRegistry()
+		}
+	})
+
+	return h.methods
 }
 
 // Register adds the method to the handler methods.
 func (h *MuxHandler) Register(name string, method Method) {
-	h.Methods[name] = MethodWithContext{
-		Url: method.Url,
-		Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
-			return method.Method(params)
-		},
-	}
+	h.registry().set(name, withContext(method))
 }
 
 // RegisterWithContext adds the method to the handler methods.
 func (h *MuxHandler) RegisterWithContext(name string, method MethodWithContext) {
-	h.Methods[name] = method
+	h.registry().set(name, method)
+}
+
+// RegisterFunc adds the typed function fn to the handler methods.
+// See NewFuncMethod for the accepted function signature.
+func (h *MuxHandler) RegisterFunc(name string, fn interface{}) error {
+	method, err := NewFuncMethod(fn)
+	if err != nil {
+		return err
+	}
+	h.registry().set(name, method)
+
+	return nil
+}
+
+// Unregister removes the method from the handler methods and reports whether it was
+// registered.
+func (h *MuxHandler) Unregister(name string) bool {
+	return h.registry().remove(name, nil)
+}
+
+// Replace replaces the method registered under the given name and reports whether a
+// method was registered under it. No method is registered if it was not.
+func (h *MuxHandler) Replace(name string, method MethodWithContext) bool {
+	return h.registry().replace(name, method)
+}
+
+// Lookup returns the handler method registered under the given name.
+func (h *MuxHandler) Lookup(name string) (MethodWithContext, bool) {
+	return h.registry().lookup(name)
+}
+
+// List returns the sorted names of the handler methods.
+func (h *MuxHandler) List() []string {
+	return h.registry().list()
+}
+
+// OnRegistryChange adds a hook that is called after every change made to the
+// handler methods.
+func (h *MuxHandler) OnRegistryChange(hook func(RegistryEvent)) {
+	h.registry().onChange(hook)
 }
 
 // NewMuxHandler creates a new mux handler instance.
 func NewMuxHandler() *MuxHandler {
-	return &MuxHandler{make(map[string]MethodWithContext)}
+	return &MuxHandler{
+		Methods: make(map[string]MethodWithContext),
+		methods: newRegistry(),
+	}
 }
 
 // MuxServer is a json rpc 2 server that handles multiple requests.
 type MuxServer struct {
-	Host     string
-	Headers  map[string]string
-	Handlers map[string]*MuxHandler
-
-	httpServer *http.Server
-	mux        *http.ServeMux
+	Host                string
+	Headers             map[string]string
+	Handlers            map[string]*MuxHandler
+	WebSocketHandlers   map[string]*MuxHandler
+	OrderedBatch        bool
+	MaxBatchSize        int
+	MaxBatchParallelism int
+	StreamBatch         bool
+	Debug               bool
+	PanicHandler        func(ctx context.Context, req *RequestObject, v interface{}, stack []byte)
+	RedactErrors        bool
+	Info                OpenRPCInfo
+	HealthCheck         *HealthCheck
+	Balancer            Balancer
+	Proxy               *ProxyConfig
+	CircuitBreaker      *CircuitBreaker
+
+	httpServer    *http.Server
+	mux           *http.ServeMux
+	interceptors  []Interceptor
+	errorMappings []errorMapping
+	servers       []*Server
 }
 
-// Prepare
+// Prepare binds all server rpcHandlers to their handler routes and returns the
+// http.Server instance but doesn't start it yet.
 func (s *MuxServer) Prepare() *http.Server {
 	for route, handler := range s.Handlers {
-		srv := &Server{
-			Host:       s.Host,
-			Methods:    handler.Methods,
-			Headers:    s.Headers,
-			httpServer: s.httpServer,
-			mux:        s.mux,
-		}
+		srv := s.newServer(handler)
 		s.mux.HandleFunc(route, srv.rpcHandler)
 		log.Println(fmt.Sprintf("adding handler at %s", route))
 	}
+	for route, handler := range s.WebSocketHandlers {
+		srv := s.newServer(handler)
+		s.mux.HandleFunc(route, srv.ServeWebSocket)
+		log.Println(fmt.Sprintf("adding websocket handler at %s", route))
+	}
 	return s.httpServer
 }
 
+// newServer creates the server that dispatches requests to the handler methods.
+func (s *MuxServer) newServer(handler *MuxHandler) *Server {
+	methods := handler.registry()
+	handler.methodsImport.Do(func() { methods.importMethods(handler.Methods) })
+
+	srv := &Server{
+		Host:                s.Host,
+		methods:             methods,
+		Headers:             s.Headers,
+		CancelMethod:        DefaultCancelMethod,
+		OrderedBatch:        s.OrderedBatch,
+		MaxBatchSize:        s.MaxBatchSize,
+		MaxBatchParallelism: s.MaxBatchParallelism,
+		StreamBatch:         s.StreamBatch,
+		Debug:               s.Debug,
+		PanicHandler:        s.PanicHandler,
+		RedactErrors:        s.RedactErrors,
+		Info:                s.Info,
+		HealthCheck:         s.HealthCheck,
+		Balancer:            s.Balancer,
+		Proxy:               s.Proxy,
+		CircuitBreaker:      s.CircuitBreaker,
+		errorMappings:       s.errorMappings,
+		health:              newHealthMonitor(),
+		circuits:            newCircuitBreakers(),
+		defaultBalancer:     RoundRobin(),
+		interceptors:        append(append([]Interceptor(nil), s.interceptors...), handler.interceptors...),
+		httpServer:          s.httpServer,
+		mux:                 s.mux,
+	}
+	srv.methods.onChange(srv.health.registryChanged)
+	srv.methods.onChange(srv.balancerChanged)
+	srv.methods.onChange(srv.proxyChanged)
+	srv.startHealthChecks()
+	s.servers = append(s.servers, srv)
+
+	return srv
+}
+
 // Start Starts binds all server rpcHandlers to their handler routes and
-// starts the http server.
+// starts the http server. It returns once the server is shut down, and exits on
+// any other serve error.
 func (s *MuxServer) Start() {
 	httpServer := s.Prepare()
 	log.Println(fmt.Sprintf("Starting server on %s", s.Host))
-	log.Fatal(httpServer.ListenAndServe())
+	logServeError(httpServer.ListenAndServe())
 }
 
 // StartTLS Starts binds all server rpcHandlers to their handler routes and
-// starts the https server.
+// starts the https server. It returns once the server is shut down, and exits on
+// any other serve error.
 func (s *MuxServer) StartTLS(certFile, keyFile string) {
 	httpServer := s.Prepare()
 	log.Println(fmt.Sprintf("Starting server on %s", s.Host))
-	log.Fatal(httpServer.ListenAndServeTLS(certFile, keyFile))
+	logServeError(httpServer.ListenAndServeTLS(certFile, keyFile))
 }
 
 // AddHandler add the handler to the mux handlers.
@@ -622,7 +1357,14 @@ func (s *MuxServer) AddHandler(route string, handler *MuxHandler) {
 	s.Handlers[route] = handler
 }
 
-// Shutdown stops the server from accepting new requests and shuts down the server.
+// AddWebSocketHandler adds the handler to the mux websocket handlers.
+// Requests to the route are served over a persistent websocket connection.
+func (s *MuxServer) AddWebSocketHandler(route string, handler *MuxHandler) {
+	s.WebSocketHandlers[route] = handler
+}
+
+// Shutdown stops the server from accepting new requests, closes the open websocket
+// connections and shuts down the server.
 // If timeout is not 0, the given context is wrapped in a new context with the given timeout.
 func (s *MuxServer) Shutdown(ctx context.Context, timeout time.Duration) error {
 	if timeout > 0 {
@@ -630,6 +1372,10 @@ func (s *MuxServer) Shutdown(ctx context.Context, timeout time.Duration) error {
 		ctx, release = context.WithTimeout(ctx, timeout)
 		defer release()
 	}
+	for _, srv := range s.servers {
+		srv.health.close()
+		srv.webSockets.close()
+	}
 	return s.httpServer.Shutdown(ctx)
 }
 
@@ -637,5 +1383,12 @@ func (s *MuxServer) Shutdown(ctx context.Context, timeout time.Duration) error {
 func NewMuxServer(host string, headers map[string]string) *MuxServer {
 	mux := http.NewServeMux()
 	httpServer := &http.Server{Addr: host, Handler: mux}
-	return &MuxServer{host, headers, make(map[string]*MuxHandler), httpServer, mux}
+	return &MuxServer{
+		Host:              host,
+		Headers:           headers,
+		Handlers:          make(map[string]*MuxHandler),
+		WebSocketHandlers: make(map[string]*MuxHandler),
+		httpServer:        httpServer,
+		mux:               mux,
+	}
 }
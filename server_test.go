@@ -11,9 +11,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -205,6 +208,62 @@ p2d2T8pkQLLdnOk/VdnNu9QR
 	return tlsCertFile.Name(), tlsKeyFile.Name()
 }
 
+// testServer is a server at /rpc served over http until the test ends, with the
+// url of its rpc route and a client of it.
+type testServer struct {
+	*Server
+	srv        *httptest.Server
+	url        string
+	client     *Client
+	middleware func(next http.HandlerFunc) http.HandlerFunc
+}
+
+// newTestServer creates a test server. The options configure the server and
+// register its methods before it is prepared.
+func newTestServer(t *testing.T, options ...func(ts *testServer)) *testServer {
+	ts := &testServer{Server: NewServer("", "/rpc", nil)}
+	for _, option := range options {
+		option(ts)
+	}
+
+	if ts.middleware != nil {
+		ts.srv = httptest.NewServer(ts.PrepareWithMiddleware(ts.middleware).Handler)
+	} else {
+		ts.srv = httptest.NewServer(ts.Prepare().Handler)
+	}
+	t.Cleanup(ts.srv.Close)
+	ts.url = ts.srv.URL + "/rpc"
+	ts.client = NewClient(ts.url, nil)
+
+	return ts
+}
+
+// withSum registers the sum method.
+func withSum(ts *testServer) {
+	ts.Register("sum", Method{Method: Sum})
+}
+
+// withProxied registers the methods proxied to the backend at url.
+func withProxied(url string, methods ...string) func(ts *testServer) {
+	return func(ts *testServer) {
+		for _, method := range methods {
+			ts.RegisterWithContext(method, MethodWithContext{Url: url})
+		}
+	}
+}
+
+// countRequests counts the http requests received by the test server in n.
+func countRequests(n *int64) func(ts *testServer) {
+	return func(ts *testServer) {
+		ts.middleware = func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(n, 1)
+				next(w, r)
+			}
+		}
+	}
+}
+
 func init() {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -694,3 +753,36 @@ func TestExplicitServerLifecycle(t *testing.T) {
 		t.Fatal(<-errs)
 	}
 }
+
+// TestStartReturnsAfterShutdown tests that Start returns instead of exiting when
+// the server is shut down
+func TestStartReturnsAfterShutdown(t *testing.T) {
+	srv := NewServer(":31503", "/api/v1/rpc", nil)
+	done := make(chan struct{})
+	go func() {
+		srv.Start()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "localhost:31503")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := srv.Shutdown(context.Background(), time.Second); err != nil {
+		t.Fatalf("Error shutting down server: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after shutdown")
+	}
+}
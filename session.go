@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// messageConn reads and writes whole json rpc messages over a persistent
+// connection.
+type messageConn interface {
+	// ReadMessage returns the next message read from the connection.
+	// It returns io.EOF when the peer has no more messages to send but can still
+	// receive responses.
+	// WriteMessage writes a single message to the connection.
+	// Close closes the connection.
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	Close() error
+}
+
+// serveConn serves rpc requests read from conn until the connection is closed.
+// Requests are handled concurrently and each response is written as soon as it
+// completes, so responses may be written in a different order than requests
+// were read. Responses to calls made through the connection's Peer are
+// delivered to the pending calls.
+func (s *Server) serveConn(ctx context.Context, conn messageConn) error {
+	s.importMethods()
+	s.loadRegistry()
+	s.startHealthChecks()
+	peer := newPeer(conn)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, peerKey{}, peer))
+
+	var wg sync.WaitGroup
+	var err error
+	for {
+		var data []byte
+		if data, err = conn.ReadMessage(); err != nil {
+			break
+		}
+		if peer.handleResponse(data) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := s.handleMessage(ctx, data); resp != nil {
+				peer.write(resp)
+			}
+		}()
+	}
+
+	// no more responses can be read, so pending calls to the peer fail. In
+	// flight requests are completed when the peer stops sending messages,
+	// otherwise they are cancelled.
+	peer.close()
+	if errors.Is(err, io.EOF) {
+		wg.Wait()
+		cancel()
+		err = nil
+	} else {
+		cancel()
+		wg.Wait()
+	}
+	conn.Close()
+
+	if errors.Is(err, errConnClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// errConnClosed is returned by a message connection closed by the peer.
+var errConnClosed = errors.New("jrpc2: connection closed")
+
+// handleMessage handles a single or batch request message read from a persistent
+// connection and returns the encoded response, or nil if there is none.
+// Requests are tracked by id while in flight so that the client can cancel them.
+func (s *Server) handleMessage(ctx context.Context, data []byte) []byte {
+	req, reqs, errObj := decodeRequest(data)
+	if errObj != nil {
+		return NewResponse(nil, errObj, nil, true)
+	}
+
+	peer, _ := PeerFromContext(ctx)
+	if req != nil {
+		var done func()
+		req.ctx, done = peer.inflight.track(ctx, req.Id)
+		defer done()
+		return s.handleRequest(req)
+	}
+
+	for _, req := range reqs {
+		var done func()
+		req.ctx, done = peer.inflight.track(ctx, req.Id)
+		defer done()
+	}
+
+	return s.handleBatch(reqs)
+}
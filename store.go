@@ -0,0 +1,379 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoredRegistration is the persisted registration of a proxied method.
+type StoredRegistration struct {
+	// Name is the name of the method.
+	// Backends contains the backends of the method.
+	Name     string          `json:"name"`
+	Backends []StoredBackend `json:"backends,omitempty"`
+}
+
+// StoredBackend is a persisted backend of a proxied method.
+type StoredBackend struct {
+	Backend
+	// TTL is the time to live of the registration in seconds, zero if it doesn't
+	// expire.
+	TTL float64 `json:"ttl,omitempty"`
+}
+
+// RegistryStore persists the proxied methods of a server so that they survive
+// restarts.
+type RegistryStore interface {
+	// Load returns the stored registrations.
+	// Save stores the registration, replacing any registration of the method.
+	// Delete removes the registration of the named method.
+	Load() ([]StoredRegistration, error)
+	Save(reg StoredRegistration) error
+	Delete(name string) error
+}
+
+// FileStore is a RegistryStore that appends each change to a log file of json
+// encoded registrations, one per line. A registration without backends deletes
+// the method. The log is compacted to the current registrations when it is
+// loaded and when it holds too many stale records.
+type FileStore struct {
+	// Path is the path of the log file, which is created if it doesn't exist.
+	// CompactThreshold is the number of stale records after which the log is
+	// compacted, 100 if zero.
+	Path             string
+	CompactThreshold int
+	mu               sync.Mutex
+	file             *os.File
+	regs             map[string]StoredRegistration
+	stale            int
+}
+
+// NewFileStore creates a registry store backed by the log file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Load reads the log and returns the stored registrations sorted by name. An
+// incomplete last record, left by an interrupted write, is ignored.
+func (f *FileStore) Load() ([]StoredRegistration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	regs := make([]StoredRegistration, 0, len(f.regs))
+	for _, reg := range f.regs {
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Name < regs[j].Name })
+
+	return regs, nil
+}
+
+// Save appends the registration to the log.
+func (f *FileStore) Save(reg StoredRegistration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.append(reg)
+}
+
+// Delete appends the removal of the named method to the log.
+func (f *FileStore) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.open(); err != nil {
+		return err
+	}
+	if _, ok := f.regs[name]; !ok {
+		return nil
+	}
+
+	return f.append(StoredRegistration{Name: name})
+}
+
+// Compact rewrites the log with only the current registrations.
+func (f *FileStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	return f.compact()
+}
+
+// Close closes the log file. The store reopens it when it is used again.
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file, f.regs = nil, nil
+
+	return err
+}
+
+// open loads the log if it isn't open yet.
+func (f *FileStore) open() error {
+	if f.file != nil {
+		return nil
+	}
+
+	return f.load()
+}
+
+// load replays the log into the current registrations and compacts it.
+func (f *FileStore) load() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	regs, err := readLog(f.Path)
+	if err != nil {
+		return err
+	}
+	f.regs = regs
+
+	return f.compact()
+}
+
+// readLog replays the log file at path and returns the current registrations by
+// name. A missing log file holds no registrations.
+func readLog(path string) (map[string]StoredRegistration, error) {
+	regs := make(map[string]StoredRegistration)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return regs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rdr := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := rdr.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		complete := err == nil
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var reg StoredRegistration
+			if err := json.Unmarshal(line, &reg); err != nil {
+				if !complete {
+					break
+				}
+				return nil, fmt.Errorf("jrpc2: registry store %s line %d: %w", path, n, err)
+			}
+			if len(reg.Backends) == 0 {
+				delete(regs, reg.Name)
+			} else {
+				regs[reg.Name] = reg
+			}
+		}
+		if !complete {
+			break
+		}
+	}
+
+	return regs, nil
+}
+
+// compact writes the current registrations to a new log that replaces the log
+// file, and opens it for appending.
+func (f *FileStore) compact() error {
+	names := make([]string, 0, len(f.regs))
+	for name := range f.regs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, name := range names {
+		if err := enc.Encode(f.regs[name]); err != nil {
+			return err
+		}
+	}
+
+	tmp := f.Path + ".tmp"
+	if err := writeFileSync(tmp, buf.Bytes()); err != nil {
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	f.file, f.stale = file, 0
+
+	return nil
+}
+
+// append writes the registration to the log and compacts the log once it holds
+// too many stale records.
+func (f *FileStore) append(reg StoredRegistration) error {
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	if _, ok := f.regs[reg.Name]; ok {
+		f.stale++
+	}
+	if len(reg.Backends) == 0 {
+		delete(f.regs, reg.Name)
+		f.stale++
+	} else {
+		f.regs[reg.Name] = reg
+	}
+
+	threshold := f.CompactThreshold
+	if threshold <= 0 {
+		threshold = 100
+	}
+	if f.stale >= threshold {
+		return f.compact()
+	}
+
+	return nil
+}
+
+// writeFileSync writes data to the file at path and syncs it to disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// loadRegistry registers the proxied methods of the registry store, and persists
+// later changes to proxied methods to it. The registry is loaded once. Changes are
+// not persisted if it fails to load, so that the store isn't overwritten.
+func (s *Server) loadRegistry() {
+	if s.RegistryStore == nil {
+		return
+	}
+
+	s.storeLoad.Do(func() {
+		regs, err := s.RegistryStore.Load()
+		if err != nil {
+			log.Printf("jrpc2: loading registry store: %v", err)
+			return
+		}
+		for _, reg := range regs {
+			s.restore(reg)
+		}
+		s.methods.onChange(s.persist)
+	})
+}
+
+// restore registers the backends of the stored registration. The registration is
+// skipped if a method is already registered under its name, such as a local method
+// or a method proxied by the server configuration.
+func (s *Server) restore(reg StoredRegistration) {
+	s.methods.update(reg.Name, func(m MethodWithContext, exists bool) (MethodWithContext, bool) {
+		if exists {
+			return m, false
+		}
+
+		restored := false
+		for _, backend := range reg.Backends {
+			var ok bool
+			if m, ok = addBackend(m, restored, backend.Backend); ok && backend.TTL > 0 {
+				s.health.setLease(reg.Name, backend.Url, time.Duration(backend.TTL*float64(time.Second)))
+			}
+			restored = restored || ok
+		}
+		return m, restored
+	})
+}
+
+// persist saves the current registration of the changed method to the registry
+// store, or deletes it if the method is no longer proxied.
+func (s *Server) persist(event RegistryEvent) {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	var err error
+	method, _ := s.methods.lookup(event.Name)
+	if backends := method.backends(); backends != nil {
+		reg := StoredRegistration{Name: event.Name}
+		for _, backend := range backends {
+			stored := StoredBackend{Backend: backend}
+			if ttl, ok := s.health.leaseTTL(event.Name, backend.Url); ok {
+				stored.TTL = ttl.Seconds()
+			}
+			reg.Backends = append(reg.Backends, stored)
+		}
+		err = s.RegistryStore.Save(reg)
+	} else {
+		err = s.RegistryStore.Delete(event.Name)
+	}
+	if err != nil {
+		log.Printf("jrpc2: persisting method %s: %v", event.Name, err)
+	}
+}
@@ -0,0 +1,147 @@
+package jrpc2
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// logLines returns the number of records in the log file at path.
+func logLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	store := NewFileStore(path)
+	store.CompactThreshold = 3
+	a := StoredRegistration{Name: "a", Backends: []StoredBackend{{Backend: Backend{Url: "http://a"}, TTL: 30}}}
+	b := StoredRegistration{Name: "b", Backends: []StoredBackend{{Backend: Backend{Url: "http://b", Weight: 2}}}}
+
+	if regs, err := store.Load(); err != nil || len(regs) != 0 {
+		t.Fatalf("Expected empty store, got %v, %v", regs, err)
+	}
+	for _, reg := range []StoredRegistration{a, b, a} {
+		if err := store.Save(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := logLines(t, path); n != 3 {
+		t.Fatalf("Expected 3 records, got %d", n)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := logLines(t, path); n != 1 {
+		t.Fatalf("Expected log to be compacted to 1 record, got %d", n)
+	}
+	if err := store.Save(b); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"name": "c", "backe`)
+	file.Close()
+
+	regs, err := NewFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(regs, []StoredRegistration{a, b}) {
+		t.Fatalf("Unexpected registrations %v", regs)
+	}
+	if n := logLines(t, path); n != 2 {
+		t.Fatalf("Expected loaded log to be compacted to 2 records, got %d", n)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	if err := ioutil.WriteFile(path, []byte("{\n"+`{"name": "a", "backends": [{"url": "http://a"}]}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileStore(path).Load(); err == nil {
+		t.Fatal("Expected corrupt log to fail to load")
+	}
+}
+
+func TestServerRegistryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	a, b := newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b")
+
+	s := NewServer("", "/rpc", nil)
+	s.RegistryStore = NewFileStore(path)
+	srv := httptest.NewServer(s.Prepare().Handler)
+	c := NewClient(srv.URL+"/rpc", nil)
+	for _, params := range [][]interface{}{
+		{"whoami", a.URL + "/rpc", 60},
+		{"whoami", b.URL + "/rpc", nil, 2},
+		{"fail", a.URL + "/rpc"},
+	} {
+		if err := c.Call(context.Background(), "jrpc2.register", params, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Call(context.Background(), "jrpc2.unregister", []string{"fail"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	restarted := NewServer("", "/rpc", nil)
+	restarted.Register("local", Method{Method: Sum})
+	restarted.RegistryStore = NewFileStore(path)
+	srv = httptest.NewServer(restarted.Prepare().Handler)
+	defer srv.Close()
+
+	if _, ok := restarted.Lookup("fail"); ok {
+		t.Fatal("Expected unregistered method not to be restored")
+	}
+	method, ok := restarted.Lookup("whoami")
+	want := []Backend{{Url: a.URL + "/rpc"}, {Url: b.URL + "/rpc", Weight: 2}}
+	if !ok || !reflect.DeepEqual(method.backends(), want) {
+		t.Fatalf("Expected backends %v to be restored, got %v", want, method.backends())
+	}
+	if ttl, ok := restarted.health.leaseTTL("whoami", a.URL+"/rpc"); !ok || ttl != time.Minute {
+		t.Fatalf("Expected ttl to be restored, got %v", ttl)
+	}
+	if names := callWhoami(t, NewClient(srv.URL+"/rpc", nil), 2, nil); names[0] == names[1] {
+		t.Fatalf("Expected restored backends to be called, got %v", names)
+	}
+}
+
+func TestServerRegistryStoreConfiguredMethod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.log")
+	a, b := newBalanceTestBackend(t, "a"), newBalanceTestBackend(t, "b")
+
+	c := newTestServer(t, func(ts *testServer) { ts.RegistryStore = NewFileStore(path) }).client
+	if err := c.Call(context.Background(), "jrpc2.register", []string{"whoami", a.URL + "/rpc"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(t, withProxied(b.URL+"/rpc", "whoami"), func(ts *testServer) {
+		ts.RegistryStore = NewFileStore(path)
+	})
+	method, _ := restarted.Lookup("whoami")
+	if want := []Backend{{Url: b.URL + "/rpc"}}; !reflect.DeepEqual(method.backends(), want) {
+		t.Fatalf("Expected configured backends %v to be kept, got %v", want, method.backends())
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Framing specifies how messages are delimited on a stream.
+type Framing int
+
+const (
+	// NewlineFraming delimits messages with a newline. Each message must be encoded
+	// on a single line.
+	NewlineFraming Framing = iota
+	// HeaderFraming prefixes each message with a Content-Length header, as used by
+	// the Language Server Protocol.
+	HeaderFraming
+)
+
+// newFramedConn creates a message connection for the framing. The closer may be
+// nil if the connection has nothing to close.
+func newFramedConn(framing Framing, r io.Reader, w io.Writer, c io.Closer) (messageConn, error) {
+	switch framing {
+	case NewlineFraming:
+		return newLineConn(r, w, c), nil
+	case HeaderFraming:
+		return newHeaderConn(r, w, c), nil
+	}
+
+	return nil, fmt.Errorf("jrpc2: unknown framing %d", framing)
+}
+
+// lineConn is a message connection that frames each message as a single line
+// terminated by a newline.
+type lineConn struct {
+	r *bufio.Reader
+	w io.Writer
+	c io.Closer
+}
+
+// newLineConn creates a newline delimited message connection. The closer may be
+// nil if the connection has nothing to close.
+func newLineConn(r io.Reader, w io.Writer, c io.Closer) *lineConn {
+	return &lineConn{r: bufio.NewReader(r), w: w, c: c}
+}
+
+// ReadMessage returns the next non-empty line read from the connection.
+// A final line without a terminating newline is returned as a message.
+func (c *lineConn) ReadMessage() ([]byte, error) {
+	for {
+		line, err := c.readLine()
+		if len(bytes.TrimSpace(line)) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLine reads a line from the connection, failing once the line exceeds the
+// maximum message size.
+func (c *lineConn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := c.r.ReadSlice('\n')
+		if len(line)+len(fragment) > maxMessageSize {
+			return nil, errors.New("jrpc2: line exceeds maximum message size")
+		}
+		line = append(line, fragment...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// WriteMessage writes the data as a single newline terminated line.
+func (c *lineConn) WriteMessage(data []byte) error {
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	_, err := c.w.Write(data)
+
+	return err
+}
+
+// Close closes the underlying connection.
+func (c *lineConn) Close() error {
+	if c.c == nil {
+		return nil
+	}
+
+	return c.c.Close()
+}
+
+// headerConn is a message connection that frames each message with a
+// Content-Length header.
+type headerConn struct {
+	r *bufio.Reader
+	w io.Writer
+	c io.Closer
+}
+
+// newHeaderConn creates a header framed message connection. The closer may be nil
+// if the connection has nothing to close.
+func newHeaderConn(r io.Reader, w io.Writer, c io.Closer) *headerConn {
+	return &headerConn{r: bufio.NewReader(r), w: w, c: c}
+}
+
+// ReadMessage reads the message headers and returns the message content.
+// Headers other than Content-Length are ignored.
+func (c *headerConn) ReadMessage() ([]byte, error) {
+	length := -1
+	headers := 0
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) && headers == 0 && strings.TrimSpace(line) == "" {
+				return nil, io.EOF
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if headers == 0 {
+				continue
+			}
+			break
+		}
+		headers++
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("jrpc2: invalid message header %q", line)
+		}
+		if textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) == "Content-Length" {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || length < 0 {
+				return nil, fmt.Errorf("jrpc2: invalid Content-Length %q", value)
+			}
+			if length > maxMessageSize {
+				return nil, fmt.Errorf("jrpc2: Content-Length %d exceeds maximum message size", length)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("jrpc2: missing Content-Length header")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// WriteMessage writes the data prefixed with its Content-Length header.
+func (c *headerConn) WriteMessage(data []byte) error {
+	data = bytes.TrimRight(data, "\n")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "Content-Length: %d\r\n\r\n", len(data))
+	msg.Write(data)
+	_, err := c.w.Write(msg.Bytes())
+
+	return err
+}
+
+// Close closes the underlying connection.
+func (c *headerConn) Close() error {
+	if c.c == nil {
+		return nil
+	}
+
+	return c.c.Close()
+}
+
+// ServeConn serves newline delimited rpc requests read from conn until the peer
+// closes the connection. Each request or batch must be encoded on a single line
+// and each response is written back on the connection as a single line.
+// Requests are handled concurrently, so responses may be written in a different
+// order than their requests. The connection is closed when ServeConn returns.
+func (s *Server) ServeConn(conn net.Conn) error {
+	return s.serveConn(context.Background(), newLineConn(conn, conn, conn))
+}
+
+// ServeListener accepts connections on l and serves each of them with ServeConn
+// in its own goroutine. It returns nil once the listener is closed.
+func (s *Server) ServeListener(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeStream serves rpc requests read from r using the framing and writes the
+// responses to w. It returns nil once r reaches EOF and every in flight request
+// has been answered. The reader and writer are not closed.
+func (s *Server) ServeStream(r io.Reader, w io.Writer, framing Framing) error {
+	conn, err := newFramedConn(framing, r, w, nil)
+	if err != nil {
+		return err
+	}
+
+	return s.serveConn(context.Background(), conn)
+}
+
+// ServeStdio serves rpc requests read from standard input using the framing and
+// writes the responses to standard output, for servers run as a subprocess.
+// It returns nil once standard input is closed.
+func (s *Server) ServeStdio(framing Framing) error {
+	return s.ServeStream(os.Stdin, os.Stdout, framing)
+}
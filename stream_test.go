@@ -0,0 +1,202 @@
+package jrpc2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readLineResponse reads a single newline delimited response from the reader.
+func readLineResponse(t *testing.T, conn net.Conn, rdr *bufio.Reader, v interface{}) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := rdr.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		t.Fatalf("Error decoding response %s: %v", line, err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	release := make(chan struct{})
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- newTestServer(t, withSum, withWait(release)).ServeConn(conn) }()
+
+	rdr := bufio.NewReader(client)
+	go func() {
+		client.Write([]byte(`{"jsonrpc": "2.0", "method": "wait", "id": 1}` + "\n"))
+		client.Write([]byte("\n"))
+		client.Write([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 2}` + "\n"))
+		client.Write([]byte(`[{"jsonrpc": "2.0", "method": "sum", "params": [2, 2], "id": 3}, {"jsonrpc": "2.0", "method": "sum", "params": [1, 1]}]` + "\n"))
+	}()
+
+	var resp JsonRpcResponse
+	readLineResponse(t, client, rdr, &resp)
+	if resp.Id != 2 || resp.Result != 3.0 {
+		t.Fatalf("Expected sum response, got %+v", resp)
+	}
+
+	var batch []JsonRpcResponse
+	readLineResponse(t, client, rdr, &batch)
+	if len(batch) != 1 || batch[0].Id != 3 || batch[0].Result != 4.0 {
+		t.Fatalf("Unexpected batch response %+v", batch)
+	}
+
+	close(release)
+	readLineResponse(t, client, rdr, &resp)
+	if resp.Id != 1 || resp.Result != "done" {
+		t.Fatalf("Expected wait response, got %+v", resp)
+	}
+
+	client.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ServeConn to return when the connection is closed")
+	}
+}
+
+func TestServeListenerUnixSocket(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "jrpc2.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- newTestServer(t, withSum).ServeListener(l) }()
+
+	for i := 1; i <= 2; i++ {
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": {"x": 1, "y": 2}, "id": 1}` + "\n"))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": [1, 2]}` + "\n"))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": [1` + "\n"))
+
+		rdr := bufio.NewReader(conn)
+		results, parseErrors := 0, 0
+		for j := 0; j < 2; j++ {
+			var resp JsonRpcResponse
+			readLineResponse(t, conn, rdr, &resp)
+			if resp.Result == 3.0 {
+				results++
+			} else if resp.Err != nil && resp.Err.Code == ParseErrorCode {
+				parseErrors++
+			}
+		}
+		if results != 1 || parseErrors != 1 {
+			t.Fatalf("Expected a result and a parse error, got %d results and %d parse errors", results, parseErrors)
+		}
+		conn.Close()
+	}
+
+	l.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ServeListener to return when the listener is closed")
+	}
+}
+
+func TestServeStreamHeaderFraming(t *testing.T) {
+	body1 := `{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 1}`
+	body2 := `{"jsonrpc": "2.0", "method": "fooba", "id": 2}`
+	in := fmt.Sprintf("Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s"+
+		"content-length: %d\r\n\r\n%s", len(body1), body1, len(body2), body2)
+	var out bytes.Buffer
+
+	if err := newTestServer(t, withSum).ServeStream(strings.NewReader(in), &out, HeaderFraming); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newHeaderConn(&out, nil, nil)
+	results := make(map[int]JsonRpcResponse)
+	for i := 0; i < 2; i++ {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp JsonRpcResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		results[resp.Id] = resp
+	}
+	if results[1].Result != 3.0 {
+		t.Fatalf("Unexpected sum response %+v", results[1])
+	}
+	if results[2].Err == nil || results[2].Err.Code != MethodNotFoundCode {
+		t.Fatalf("Expected method not found response, got %+v", results[2])
+	}
+	if _, err := conn.ReadMessage(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestServeStreamNewlineFraming(t *testing.T) {
+	in := `{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 1}`
+	var out bytes.Buffer
+
+	if err := newTestServer(t, withSum).ServeStream(strings.NewReader(in), &out, NewlineFraming); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != `{"jsonrpc":"2.0","result":3,"id":1}`+"\n" {
+		t.Fatalf("Unexpected output %q", out.String())
+	}
+}
+
+func TestServeStreamTruncatedMessage(t *testing.T) {
+	in := "Content-Length: 100\r\n\r\n{\"jsonrpc\": \"2.0\""
+	var out bytes.Buffer
+
+	err := newTestServer(t, withSum).ServeStream(strings.NewReader(in), &out, HeaderFraming)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, got %v", err)
+	}
+
+	err = newTestServer(t, withSum).ServeStream(strings.NewReader("Content-Type: text\r\n\r\n"), &out, HeaderFraming)
+	if err == nil {
+		t.Fatal("Expected missing Content-Length error")
+	}
+}
+
+func TestServeStreamMessageTooLarge(t *testing.T) {
+	in := "Content-Length: 99999999999\r\n\r\n{}"
+	var out bytes.Buffer
+
+	err := newTestServer(t, withSum).ServeStream(strings.NewReader(in), &out, HeaderFraming)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum message size") {
+		t.Fatalf("Expected message too large error, got %v", err)
+	}
+}
+
+func TestServeStreamLineTooLarge(t *testing.T) {
+	in := `{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 1}` + "\n" + strings.Repeat(" ", maxMessageSize+1)
+	var out bytes.Buffer
+
+	err := newTestServer(t, withSum).ServeStream(strings.NewReader(in), &out, NewlineFraming)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum message size") {
+		t.Fatalf("Expected line too large error, got %v", err)
+	}
+	if out.String() != `{"jsonrpc":"2.0","result":3,"id":1}`+"\n" {
+		t.Fatalf("Expected the messages before the line to be answered, got %q", out.String())
+	}
+}
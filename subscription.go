@@ -0,0 +1,229 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+)
+
+// SubscriptionMethod is the method name of the notifications sent to subscribers.
+const SubscriptionMethod = "jrpc2.subscription"
+
+// Topic is a named stream of results published to subscribed clients.
+// Clients subscribe to a topic with the jrpc2.subscribe method over a persistent
+// connection and receive a jrpc2.subscription notification for every published
+// result.
+type Topic struct {
+	// Name is the name clients subscribe to.
+	Name string
+	ps   *pubsub
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+// SubscriptionNotification is the params of a subscription notification.
+type SubscriptionNotification struct {
+	// Subscription is the subscription id returned by jrpc2.subscribe.
+	// Result is the published result.
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result"`
+}
+
+// SubscribeParams is a parameter spec for the jrpc2.subscribe method.
+type SubscribeParams struct {
+	// Topic is the name of the topic to subscribe to.
+	Topic *string `json:"topic" jrpc:"pos=0,required"`
+}
+
+// UnsubscribeParams is a parameter spec for the jrpc2.unsubscribe method.
+type UnsubscribeParams struct {
+	// Subscription is the id of the subscription to cancel.
+	Subscription *string `json:"subscription" jrpc:"pos=0,required"`
+}
+
+// subscription is a single client subscription to a topic.
+type subscription struct {
+	id    string
+	topic *Topic
+	peer  *Peer
+	stop  chan struct{}
+}
+
+// pubsub tracks the topics and subscriptions of a server.
+type pubsub struct {
+	mu     sync.Mutex
+	topics map[string]*Topic
+	subs   map[string]*subscription
+}
+
+// newPubsub creates an empty topic and subscription registry.
+func newPubsub() *pubsub {
+	return &pubsub{
+		topics: make(map[string]*Topic),
+		subs:   make(map[string]*subscription),
+	}
+}
+
+// RegisterTopic creates the named topic, or returns it if it already exists.
+func (s *Server) RegisterTopic(name string) *Topic {
+	s.pubsub.mu.Lock()
+	defer s.pubsub.mu.Unlock()
+
+	if topic, ok := s.pubsub.topics[name]; ok {
+		return topic
+	}
+	topic := &Topic{Name: name, ps: s.pubsub, subs: make(map[string]*subscription)}
+	s.pubsub.topics[name] = topic
+
+	return topic
+}
+
+// Publish sends the result to every subscriber of the topic and returns the
+// number of subscribers it was sent to.
+func (t *Topic) Publish(result interface{}) int {
+	t.mu.Lock()
+	subs := make([]*subscription, 0, len(t.subs))
+	for _, sub := range t.subs {
+		subs = append(subs, sub)
+	}
+	t.mu.Unlock()
+
+	sent := 0
+	for _, sub := range subs {
+		params := &SubscriptionNotification{Subscription: sub.id, Result: result}
+		if err := sub.peer.Notify(context.Background(), SubscriptionMethod, params); err == nil {
+			sent++
+		}
+	}
+
+	return sent
+}
+
+// Subscribers returns the number of subscribers of the topic.
+func (t *Topic) Subscribers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.subs)
+}
+
+// Subscribe creates a subscription of the client to a topic and returns the
+// subscription id. It must be called over a persistent connection.
+func (s *Server) Subscribe(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	p := new(SubscribeParams)
+	if err := ParseParams(params, p); err != nil {
+		return nil, err
+	}
+
+	peer, ok := PeerFromContext(ctx)
+	if !ok {
+		return nil, &ErrorObject{
+			Code:    SubscriptionErrorCode,
+			Message: SubscriptionErrorMsg,
+			Data:    "subscriptions require a persistent connection",
+		}
+	}
+
+	s.pubsub.mu.Lock()
+	topic, ok := s.pubsub.topics[*p.Topic]
+	s.pubsub.mu.Unlock()
+	if !ok {
+		return nil, &ErrorObject{
+			Code:    InvalidParamsCode,
+			Message: InvalidParamsMsg,
+			Data:    "unknown topic " + *p.Topic,
+		}
+	}
+
+	sub := &subscription{
+		id:    newSubscriptionId(),
+		topic: topic,
+		peer:  peer,
+		stop:  make(chan struct{}),
+	}
+	s.pubsub.mu.Lock()
+	s.pubsub.subs[sub.id] = sub
+	s.pubsub.mu.Unlock()
+	topic.mu.Lock()
+	topic.subs[sub.id] = sub
+	topic.mu.Unlock()
+
+	go func() {
+		select {
+		case <-peer.Done():
+			s.pubsub.remove(sub.id)
+		case <-sub.stop:
+		}
+	}()
+
+	return sub.id, nil
+}
+
+// Unsubscribe cancels a subscription created on the same connection and
+// reports whether the subscription existed.
+func (s *Server) Unsubscribe(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+	p := new(UnsubscribeParams)
+	if err := ParseParams(params, p); err != nil {
+		return nil, err
+	}
+
+	peer, _ := PeerFromContext(ctx)
+	s.pubsub.mu.Lock()
+	sub, ok := s.pubsub.subs[*p.Subscription]
+	s.pubsub.mu.Unlock()
+	if !ok || sub.peer != peer {
+		return false, nil
+	}
+
+	if s.pubsub.remove(sub.id) {
+		close(sub.stop)
+	}
+
+	return true, nil
+}
+
+// remove deletes the subscription and reports whether it existed.
+func (ps *pubsub) remove(id string) bool {
+	ps.mu.Lock()
+	sub, ok := ps.subs[id]
+	delete(ps.subs, id)
+	ps.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	sub.topic.mu.Lock()
+	delete(sub.topic.subs, id)
+	sub.topic.mu.Unlock()
+
+	return true
+}
+
+// newSubscriptionId returns a random subscription id.
+func newSubscriptionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
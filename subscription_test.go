@@ -0,0 +1,101 @@
+package jrpc2
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscription(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	topic := s.RegisterTopic("blocks")
+	if s.RegisterTopic("blocks") != topic {
+		t.Fatal("Expected existing topic to be returned")
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "jrpc2.subscribe", "params": ["blocks"], "id": 1}` + "\n"))
+	resp := readMessage(t, client, rdr)
+	id, ok := resp["result"].(string)
+	if !ok || id == "" {
+		t.Fatalf("Expected subscription id, got %v", resp)
+	}
+	if n := topic.Subscribers(); n != 1 {
+		t.Fatalf("Expected 1 subscriber, got %d", n)
+	}
+
+	sent := make(chan int, 1)
+	go func() { sent <- topic.Publish(map[string]int{"number": 7}) }()
+	msg := readMessage(t, client, rdr)
+	params, _ := msg["params"].(map[string]interface{})
+	if msg["method"] != SubscriptionMethod || params["subscription"] != id {
+		t.Fatalf("Unexpected notification %v", msg)
+	}
+	if result, _ := params["result"].(map[string]interface{}); result["number"] != 7.0 {
+		t.Fatalf("Unexpected notification result %v", params["result"])
+	}
+	if n := <-sent; n != 1 {
+		t.Fatalf("Expected publish to 1 subscriber, got %d", n)
+	}
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "jrpc2.unsubscribe", "params": ["` + id + `"], "id": 2}` + "\n"))
+	if resp := readMessage(t, client, rdr); resp["result"] != true {
+		t.Fatalf("Expected unsubscribe to succeed, got %v", resp)
+	}
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "jrpc2.unsubscribe", "params": {"subscription": "` + id + `"}, "id": 3}` + "\n"))
+	if resp := readMessage(t, client, rdr); resp["result"] != false {
+		t.Fatalf("Expected second unsubscribe to fail, got %v", resp)
+	}
+	if n := topic.Publish("ignored"); n != 0 {
+		t.Fatalf("Expected publish to no subscribers, got %d", n)
+	}
+}
+
+func TestSubscriptionConnectionClose(t *testing.T) {
+	s := NewServer("", "/rpc", nil)
+	topic := s.RegisterTopic("events")
+
+	client, conn := net.Pipe()
+	go s.ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "jrpc2.subscribe", "params": {"topic": "events"}, "id": 1}` + "\n"))
+	readMessage(t, client, rdr)
+	client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for topic.Subscribers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected subscription to be removed when the connection closes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriptionErrors(t *testing.T) {
+	s := newTestServer(t, func(ts *testServer) {
+		ts.RegisterTopic("blocks")
+	})
+
+	err := s.client.Call(context.Background(), "jrpc2.subscribe", []string{"blocks"}, nil)
+	if errObj, ok := err.(*ErrorObject); !ok || errObj.Code != SubscriptionErrorCode {
+		t.Fatalf("Expected subscription error over http, got %v", err)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.ServeConn(conn)
+	rdr := bufio.NewReader(client)
+
+	go client.Write([]byte(`{"jsonrpc": "2.0", "method": "jrpc2.subscribe", "params": ["trades"], "id": 1}` + "\n"))
+	resp := readMessage(t, client, rdr)
+	if errObj, _ := resp["error"].(map[string]interface{}); errObj["code"] != float64(InvalidParamsCode) {
+		t.Fatalf("Expected invalid params error for unknown topic, got %v", resp)
+	}
+}
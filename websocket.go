@@ -0,0 +1,374 @@
+// Copyright (c) 2017 Jared Patrick <jared.patrick@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jrpc2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the key suffix used to compute the websocket accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxMessageSize is the maximum size of a websocket message or of a newline or
+// Content-Length framed stream message.
+const maxMessageSize = 32 << 20
+
+// Websocket frame opcodes.
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+// wsConn is a websocket connection that implements messageConn.
+type wsConn struct {
+	// mask indicates that written frames are masked and read frames are not,
+	// which is the behavior of the client end of a connection.
+	conn    net.Conn
+	r       *bufio.Reader
+	mask    bool
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// ServeWebSocket upgrades the http request to a websocket connection and serves
+// rpc requests sent as text or binary messages until the connection is closed.
+// Requests and batches are handled concurrently and each response is written as
+// soon as it completes.
+func (s *Server) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, s.Headers)
+	if err != nil {
+		return
+	}
+	if !s.webSockets.add(conn) {
+		conn.Close()
+		return
+	}
+	defer s.webSockets.remove(conn)
+
+	s.serveConn(context.WithValue(r.Context(), httpRequestKey{}, r), conn)
+}
+
+// webSocketSet is the set of open websocket connections of a server. Hijacked
+// connections are not closed by the http server, so the set closes them when the
+// server is shut down.
+type webSocketSet struct {
+	mu     sync.Mutex
+	conns  map[*wsConn]struct{}
+	closed bool
+}
+
+// add adds the connection to the set and reports whether it was added. No
+// connection is added once the set is closed.
+func (set *webSocketSet) add(conn *wsConn) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if set.closed {
+		return false
+	}
+	if set.conns == nil {
+		set.conns = make(map[*wsConn]struct{})
+	}
+	set.conns[conn] = struct{}{}
+
+	return true
+}
+
+// remove removes the connection from the set.
+func (set *webSocketSet) remove(conn *wsConn) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	delete(set.conns, conn)
+}
+
+// close closes every connection of the set, which accepts no connections after.
+func (set *webSocketSet) close() {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	set.closed = true
+	for conn := range set.conns {
+		conn.Close()
+	}
+}
+
+// upgradeWebSocket validates the websocket handshake request, hijacks the http
+// connection and writes the handshake response. An http error is written if the
+// handshake fails.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, headers map[string]string) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "websocket handshake must use GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("jrpc2: invalid websocket handshake method")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("jrpc2: missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("jrpc2: unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("jrpc2: missing websocket key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("jrpc2: response writer does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.WriteString("Upgrade: websocket\r\n")
+	resp.WriteString("Connection: Upgrade\r\n")
+	fmt.Fprintf(&resp, "Sec-WebSocket-Accept: %s\r\n", websocketAccept(key))
+	for header, value := range headers {
+		fmt.Fprintf(&resp, "%s: %s\r\n", header, value)
+	}
+	resp.WriteString("\r\n")
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, r: brw.Reader}, nil
+}
+
+// websocketAccept computes the accept key for the websocket key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma separated header contains the token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ReadMessage returns the payload of the next text or binary message.
+// Control frames are handled while reading and fragmented messages are joined.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	fragmented := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, errConnClosed
+			}
+			return nil, err
+		}
+
+		switch op {
+		case wsClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return nil, errConnClosed
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsText, wsBinary:
+			if fragmented {
+				return nil, errors.New("jrpc2: websocket message interrupted by new message")
+			}
+			msg = payload
+		case wsContinuation:
+			if !fragmented {
+				return nil, errors.New("jrpc2: unexpected websocket continuation frame")
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, fmt.Errorf("jrpc2: unknown websocket opcode %#x", op)
+		}
+
+		if len(msg) > maxMessageSize {
+			return nil, errors.New("jrpc2: websocket message too large")
+		}
+		if fin {
+			return msg, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads a single websocket frame and returns its unmasked payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("jrpc2: websocket reserved bits set")
+	}
+	if masked == c.mask {
+		return false, 0, nil, errors.New("jrpc2: invalid websocket frame masking")
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsClose && (n > 125 || !fin) {
+		return false, 0, nil, errors.New("jrpc2: invalid websocket control frame")
+	}
+	if n > maxMessageSize {
+		return false, 0, nil, errors.New("jrpc2: websocket message too large")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, key[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(key, payload)
+	}
+
+	return fin, op, payload, nil
+}
+
+// WriteMessage writes the data as a single text message.
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.writeFrame(wsText, bytes.TrimRight(data, "\n"))
+}
+
+// writeFrame writes a single final websocket frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return errConnClosed
+	}
+
+	var frame bytes.Buffer
+	frame.WriteByte(0x80 | op)
+	var maskBit byte
+	if c.mask {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame.WriteByte(maskBit | byte(n))
+	case n <= 0xffff:
+		frame.WriteByte(maskBit | 126)
+		binary.Write(&frame, binary.BigEndian, uint16(n))
+	default:
+		frame.WriteByte(maskBit | 127)
+		binary.Write(&frame, binary.BigEndian, uint64(n))
+	}
+
+	if c.mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame.Write(key[:])
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		maskBytes(key, masked)
+		payload = masked
+	}
+	frame.Write(payload)
+
+	if op == wsClose {
+		c.closed = true
+	}
+	_, err := c.conn.Write(frame.Bytes())
+
+	return err
+}
+
+// Close sends a normal closure frame and closes the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return c.conn.Close()
+}
+
+// maskBytes applies the websocket masking key to b in place.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
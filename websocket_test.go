@@ -0,0 +1,204 @@
+package jrpc2
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens a client websocket connection to the http test server route.
+func dialWebSocket(t *testing.T, srv *httptest.Server, route string) *wsConn {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", route, srv.Listener.Addr(), key)
+
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept key %q", accept)
+	}
+
+	return &wsConn{conn: conn, r: rdr, mask: true}
+}
+
+// readResponse reads a single response object from the websocket connection.
+func readWebSocketResponse(t *testing.T, c *wsConn) JsonRpcResponse {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp JsonRpcResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("Error decoding response %s: %v", data, err)
+	}
+
+	return resp
+}
+
+// withWait registers the wait method, which answers once release is closed.
+func withWait(release chan struct{}) func(ts *testServer) {
+	return func(ts *testServer) {
+		ts.RegisterWithContext("wait", MethodWithContext{
+			Method: func(ctx context.Context, params json.RawMessage) (interface{}, *ErrorObject) {
+				<-release
+				return "done", nil
+			},
+		})
+	}
+}
+
+// withWebSocket serves the test server over websockets at /ws.
+func withWebSocket(ts *testServer) {
+	ts.WebSocketRoute = "/ws"
+}
+
+func TestWebSocketInterleavedRequests(t *testing.T) {
+	release := make(chan struct{})
+	c := dialWebSocket(t, newTestServer(t, withWebSocket, withSum, withWait(release)).srv, "/ws")
+
+	c.WriteMessage([]byte(`{"jsonrpc": "2.0", "method": "wait", "id": 1}`))
+	c.WriteMessage([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 2}`))
+
+	resp := readWebSocketResponse(t, c)
+	if resp.Id != 2 || resp.Result != 3.0 {
+		t.Fatalf("Expected sum response first, got %+v", resp)
+	}
+
+	close(release)
+	resp = readWebSocketResponse(t, c)
+	if resp.Id != 1 || resp.Result != "done" {
+		t.Fatalf("Expected wait response, got %+v", resp)
+	}
+}
+
+func TestWebSocketBatch(t *testing.T) {
+	c := dialWebSocket(t, newTestServer(t, withWebSocket, withSum).srv, "/ws")
+
+	c.WriteMessage([]byte(`[
+        {"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 1},
+        {"jsonrpc": "2.0", "method": "sum", "params": [3, 4]},
+        {"jsonrpc": "2.0", "method": "fooba", "id": 2}
+    ]`))
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resps []JsonRpcResponse
+	if err := json.Unmarshal(data, &resps); err != nil {
+		t.Fatal(err)
+	}
+	if len(resps) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(resps))
+	}
+
+	c.WriteMessage([]byte(`{"jsonrpc": "2.0", "method"`))
+	if resp := readWebSocketResponse(t, c); resp.Err == nil || resp.Err.Code != ParseErrorCode {
+		t.Fatalf("Expected parse error, got %+v", resp)
+	}
+}
+
+func TestWebSocketFragmentedMessage(t *testing.T) {
+	c := dialWebSocket(t, newTestServer(t, withWebSocket, withSum).srv, "/ws")
+
+	msg := `{"jsonrpc": "2.0", "method": "sum", "params": [5, 6], "id": 7}`
+	c.writeFrame(wsPing, []byte("ping"))
+	// write the message in two frames, the first without the fin bit and
+	// with a zero masking key
+	frame := []byte{wsText, 0x80 | 10, 0, 0, 0, 0}
+	c.conn.Write(append(frame, msg[:10]...))
+	c.writeFrame(wsContinuation, []byte(msg[10:]))
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fin, op, payload, err := c.readFrame()
+	if err != nil || !fin || op != wsPong || string(payload) != "ping" {
+		t.Fatalf("Expected pong frame, got %v %v %q %v", fin, op, payload, err)
+	}
+	if resp := readWebSocketResponse(t, c); resp.Id != 7 || resp.Result != 11.0 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	s := newTestServer(t, withWebSocket, withSum)
+	c := dialWebSocket(t, s.srv, "/ws")
+	c.WriteMessage([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": [1, 2], "id": 1}`))
+	readWebSocketResponse(t, c)
+
+	if err := s.Shutdown(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.ReadMessage(); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Expected the connection to be closed on shutdown, got %v", err)
+	}
+
+	c = dialWebSocket(t, s.srv, "/ws")
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.ReadMessage(); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Expected connections after shutdown to be closed, got %v", err)
+	}
+}
+
+func TestWebSocketHandshakeRequired(t *testing.T) {
+	srv := newTestServer(t, withWebSocket, withSum).srv
+
+	resp, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestMuxServerWebSocket(t *testing.T) {
+	h := NewMuxHandler()
+	h.Register("sum", Method{Method: Sum})
+	s := NewMuxServer("", nil)
+	s.AddHandler("/rpc", h)
+	s.AddWebSocketHandler("/ws", h)
+	srv := httptest.NewServer(s.Prepare().Handler)
+	defer srv.Close()
+
+	c := dialWebSocket(t, srv, "/ws")
+	c.WriteMessage([]byte(`{"jsonrpc": "2.0", "method": "sum", "params": {"x": 1, "y": 1}, "id": "a"}`))
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"result":2`) {
+		t.Fatalf("Unexpected response %s", data)
+	}
+
+	if err := s.Shutdown(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.ReadMessage(); !errors.Is(err, errConnClosed) {
+		t.Fatalf("Expected the connection to be closed on shutdown, got %v", err)
+	}
+}